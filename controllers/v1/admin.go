@@ -0,0 +1,234 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v1
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/pkg/clients"
+	"github.com/gin-gonic/gin"
+	"hawton.dev/log4g"
+)
+
+func GetAdminClients(c *gin.Context) {
+	list, err := clients.List()
+	if err != nil {
+		log4g.Category("controllers/admin").Error("Error listing clients: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Internal Server Error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+func GetAdminClient(c *gin.Context) {
+	id, ok := idParam(c)
+	if !ok {
+		return
+	}
+
+	client, err := clients.Get(id)
+	if err != nil {
+		adminError(c, "getting", id, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, client)
+}
+
+func PostAdminClient(c *gin.Context) {
+	req := clients.Client{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Bad Request"})
+		return
+	}
+
+	client, err := clients.Create(&req, actor(c))
+	if err != nil {
+		adminError(c, "creating", 0, err)
+		return
+	}
+
+	log4g.Category("controllers/admin").Info("Client %d (%s) created by %d", client.ID, client.Name, actor(c))
+	c.JSON(http.StatusCreated, client)
+}
+
+func PutAdminClient(c *gin.Context) {
+	id, ok := idParam(c)
+	if !ok {
+		return
+	}
+
+	req := clients.Client{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Bad Request"})
+		return
+	}
+
+	client, err := clients.Update(id, &req, actor(c))
+	if err != nil {
+		adminError(c, "updating", id, err)
+		return
+	}
+
+	log4g.Category("controllers/admin").Info("Client %d updated by %d", id, actor(c))
+	c.JSON(http.StatusOK, client)
+}
+
+func DeleteAdminClient(c *gin.Context) {
+	id, ok := idParam(c)
+	if !ok {
+		return
+	}
+
+	if err := clients.Delete(id, actor(c)); err != nil {
+		adminError(c, "deleting", id, err)
+		return
+	}
+
+	log4g.Category("controllers/admin").Info("Client %d deleted by %d", id, actor(c))
+	c.Status(http.StatusNoContent)
+}
+
+type SecretRequest struct {
+	PreviousExpiresIn int `json:"previous_expires_in"` // Seconds the old secret keeps working, 0 revokes it at once
+	ExpiresIn         int `json:"expires_in"`          // Seconds until the new secret expires, 0 never
+}
+
+func PostAdminClientSecret(c *gin.Context) {
+	id, ok := idParam(c)
+	if !ok {
+		return
+	}
+
+	req := SecretRequest{}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil || req.PreviousExpiresIn < 0 || req.ExpiresIn < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Bad Request"})
+			return
+		}
+	}
+
+	client, err := clients.RegenerateSecret(id, actor(c), time.Duration(req.PreviousExpiresIn)*time.Second, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		adminError(c, "regenerating the secret of", id, err)
+		return
+	}
+
+	log4g.Category("controllers/admin").Info("Secret of client %d regenerated by %d", id, actor(c))
+	c.JSON(http.StatusOK, client)
+}
+
+type InitialAccessTokenRequest struct {
+	Description string `json:"description"`
+	ExpiresIn   int    `json:"expires_in"` // Seconds, defaults to a day
+}
+
+func GetAdminInitialAccessTokens(c *gin.Context) {
+	list, err := clients.ListInitialAccessTokens()
+	if err != nil {
+		log4g.Category("controllers/admin").Error("Error listing initial access tokens: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Internal Server Error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// PostAdminInitialAccessToken issues a token for the registration endpoint,
+// the token itself is only returned here.
+func PostAdminInitialAccessToken(c *gin.Context) {
+	req := InitialAccessTokenRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil || req.ExpiresIn < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Bad Request"})
+		return
+	}
+	if req.ExpiresIn == 0 {
+		req.ExpiresIn = 86400
+	}
+
+	token, initial, err := clients.IssueInitialAccessToken(req.Description, time.Duration(req.ExpiresIn)*time.Second, actor(c))
+	if err != nil {
+		log4g.Category("controllers/admin").Error("Error issuing initial access token: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Internal Server Error"})
+		return
+	}
+
+	log4g.Category("controllers/admin").Info("Initial access token %d issued by %d", initial.ID, actor(c))
+	c.JSON(http.StatusCreated, gin.H{
+		"id":                   initial.ID,
+		"initial_access_token": token,
+		"description":          initial.Description,
+		"expires_at":           initial.ExpiresAt,
+	})
+}
+
+func DeleteAdminInitialAccessToken(c *gin.Context) {
+	id, ok := idParam(c)
+	if !ok {
+		return
+	}
+
+	if err := clients.DeleteInitialAccessToken(id); err != nil {
+		if errors.Is(err, clients.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"message": "Not Found"})
+			return
+		}
+		log4g.Category("controllers/admin").Error("Error deleting initial access token %d: %s", id, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Internal Server Error"})
+		return
+	}
+
+	log4g.Category("controllers/admin").Info("Initial access token %d deleted by %d", id, actor(c))
+	c.Status(http.StatusNoContent)
+}
+
+func idParam(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Not Found"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// actor is the CID of the user making the request, jwt.Auth put them there.
+func actor(c *gin.Context) uint {
+	user, _ := c.Keys["x-user"].(*dbTypes.User)
+	if user == nil {
+		return 0
+	}
+	return user.CID
+}
+
+func adminError(c *gin.Context, action string, id uint, err error) {
+	switch {
+	case errors.Is(err, clients.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": "Not Found"})
+	case clients.IsInvalid(err):
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+	default:
+		log4g.Category("controllers/admin").Error("Error %s client %d: %s", action, id, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Internal Server Error"})
+	}
+}
@@ -22,12 +22,16 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
+	"strings"
 	"time"
 
 	dbTypes "github.com/adh-partnership/api/pkg/database/models"
 	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/pkg/idp"
+	loginpkg "github.com/adh-partnership/sso/pkg/login"
+	"github.com/adh-partnership/sso/pkg/utils"
 	"github.com/gin-gonic/gin"
+	"github.com/lestrrat-go/jwx/v2/jwt"
 	gonanoid "github.com/matoous/go-nanoid/v2"
 	"hawton.dev/log4g"
 )
@@ -40,6 +44,9 @@ type AuthorizeRequest struct {
 	CodeChallengeMethod string `form:"code_challenge_method"`
 	CodeChallenge       string `form:"code_challenge"`
 	State               string `form:"state"`
+	Nonce               string `form:"nonce"`
+	Request             string `form:"request"`
+	RequestURI          string `form:"request_uri"`
 }
 
 func GetAuthorize(c *gin.Context) {
@@ -55,12 +62,38 @@ func GetAuthorize(c *gin.Context) {
 		return
 	}
 
+	// RFC9101, only the parameters inside a signed request object count
+	if req.Request != "" || req.RequestURI != "" {
+		token, err := loginpkg.RequestObject(c.Request.Context(), &client, req.Request, req.RequestURI, []string{
+			issuerURL(),
+			utils.Getenv("SSO_ISSUERKEY", "auth.denartcc.org"),
+		})
+		if err != nil {
+			log4g.Category("controllers/authorize").Error("Invalid request object received from client " + client.ClientID + ", " + err.Error())
+			handleError(c, "Invalid Request Object Received.")
+			return
+		}
+		req = authorizeRequestFromToken(token)
+	}
+
 	if ok, _ := client.ValidURI(req.RedirectURI); !ok {
 		log4g.Category("controllers/authorize").Error("Unauthorized redirect uri received from client " + client.ClientID + ", " + req.RedirectURI)
 		handleError(c, "The Return URI was not authorized.")
 		return
 	}
 
+	settings, err := models.GetClientSettings(client.ID)
+	if err != nil {
+		log4g.Category("controllers/authorize").Error("Error loading settings for client " + client.ClientID + ", " + err.Error())
+		handleError(c, "Internal Server Error.")
+		return
+	}
+	if !settings.AllowsGrantType("authorization_code") {
+		log4g.Category("controllers/authorize").Error("Authorization code grant not allowed for client " + client.ClientID)
+		redirectError(c, req.RedirectURI, req.State, "unauthorized_client", "The client is not allowed to use the authorization code grant.")
+		return
+	}
+
 	if req.ResponseType != "code" {
 		log4g.Category("controllers/authorize").Error("Invalid response type received from client " + client.ClientID + ", " + req.ResponseType)
 		handleError(c, "Unsupported response type received.")
@@ -73,6 +106,20 @@ func GetAuthorize(c *gin.Context) {
 		return
 	}
 
+	// RFC7636 4.4.1, public clients have nothing but PKCE to protect their codes
+	if settings.RequiresPKCE() && (req.CodeChallenge == "" || req.CodeChallengeMethod != "S256") {
+		log4g.Category("controllers/authorize").Error("Missing code challenge from client " + client.ClientID + ", PKCE is required")
+		redirectError(c, req.RedirectURI, req.State, "invalid_request", "PKCE with the S256 code challenge method is required for this client.")
+		return
+	}
+
+	scopes := loginpkg.SplitScopes([]string{req.Scope})
+	if err := loginpkg.ValidateScopes(&client, scopes); err != nil {
+		log4g.Category("controllers/authorize").Error("Invalid scope received from client " + client.ClientID + ", " + req.Scope)
+		redirectError(c, req.RedirectURI, req.State, "invalid_scope", "The requested scope is invalid or not allowed for this client.")
+		return
+	}
+
 	token, err := gonanoid.New(32)
 	if err != nil {
 		log4g.Category("controllers/authorize").Error("Error generating new token " + err.Error())
@@ -82,7 +129,7 @@ func GetAuthorize(c *gin.Context) {
 
 	login := dbTypes.OAuthLogin{
 		Token:               token,
-		Nonce:               c.Param("nonce"),
+		Nonce:               req.Nonce,
 		UserAgent:           c.Request.UserAgent(),
 		IP:                  c.ClientIP(),
 		RedirectURI:         req.RedirectURI,
@@ -91,8 +138,8 @@ func GetAuthorize(c *gin.Context) {
 		State:               req.State,
 		CodeChallenge:       req.CodeChallenge,
 		CodeChallengeMethod: req.CodeChallengeMethod,
-		Scope:               req.Scope,
-		ExpiresAt:           time.Now().Add(time.Minute * 5),
+		Scope:               strings.Join(scopes, " "),
+		ExpiresAt:           time.Now().Add(loginpkg.AuthorizationCodeLifetime),
 	}
 
 	if err = models.DB.Create(&login).Error; err != nil {
@@ -101,26 +148,61 @@ func GetAuthorize(c *gin.Context) {
 		return
 	}
 
+	redirectToUpstream(c, &login)
+}
+
+func authorizeRequestFromToken(token jwt.Token) AuthorizeRequest {
+	get := func(name string) string {
+		if v, ok := token.Get(name); ok {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+
+	return AuthorizeRequest{
+		ClientID:            get("client_id"),
+		RedirectURI:         get("redirect_uri"),
+		ResponseType:        get("response_type"),
+		Scope:               get("scope"),
+		CodeChallengeMethod: get("code_challenge_method"),
+		CodeChallenge:       get("code_challenge"),
+		State:               get("state"),
+		Nonce:               get("nonce"),
+	}
+}
+
+// redirectError sends an OAuth error back to the client. Only use this once the
+// redirect uri has been validated, anything before that must use handleError.
+func redirectError(c *gin.Context, redirectURI, state, code, description string) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		handleError(c, description)
+		return
+	}
+
+	q := u.Query()
+	q.Set("error", code)
+	q.Set("error_description", description)
+	if state != "" {
+		q.Set("state", state)
+	}
+	u.RawQuery = q.Encode()
+
+	c.Redirect(http.StatusFound, u.String())
+}
+
+// redirectToUpstream sends the user to the upstream identity provider for a
+// stored login, the callback finds the login again through the sso_token cookie.
+func redirectToUpstream(c *gin.Context, login *dbTypes.OAuthLogin) {
 	scheme := "https"
-	returnUri := url.QueryEscape(fmt.Sprintf("%s://%s/oauth/callback", scheme, c.Request.Host))
+	returnUri := fmt.Sprintf("%s://%s/oauth/callback", scheme, c.Request.Host)
 	/*
 		host, _, _ := net.SplitHostPort(c.Request.Host)
 		if host == "" {
 			host = c.Request.Host
 		}
 		log4g.Category("test").Debug(host) */
-	c.SetCookie("sso_token", login.Token, int(time.Minute)*5, "/", c.Request.Host, false, true)
-
-	//redirect_url := fmt.Sprintf("https://login.vatusa.net/uls/v2/login?fac=%s&url=%s&rfc7519_compliance", utils.Getenv("ULS_FACILITY_ID", "ZAU"), utils.Getenv("ULS_REDIRECT_ID", "1"))
-
-	//		redirect_uri := url.QueryEscape(os.Getenv("VATSIM_REDIRECT_URI"))
-	vatsim_url := fmt.Sprintf("%s%s?client_id=%s&redirect_uri=%s&scope=%s&response_type=code",
-		os.Getenv("VATSIM_BASE_URL"),
-		os.Getenv("VATSIM_AUTHORIZE_PATH"),
-		os.Getenv("VATSIM_OAUTH_CLIENT_ID"),
-		returnUri,
-		url.QueryEscape(os.Getenv("VATSIM_OAUTH_SCOPES")),
-	)
+	c.SetCookie("sso_token", login.Token, int(loginpkg.AuthorizationCodeLifetime.Seconds()), "/", c.Request.Host, false, true)
 
-	c.Redirect(http.StatusTemporaryRedirect, vatsim_url)
+	c.Redirect(http.StatusTemporaryRedirect, idp.Current.AuthURL(returnUri, ""))
 }
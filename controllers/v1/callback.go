@@ -19,65 +19,20 @@
 package v1
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"os"
-	"strconv"
-	"strings"
 	"time"
 
 	dbTypes "github.com/adh-partnership/api/pkg/database/models"
 	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/pkg/idp"
+	loginpkg "github.com/adh-partnership/sso/pkg/login"
 	"github.com/gin-gonic/gin"
 	gonanoid "github.com/matoous/go-nanoid/v2"
 	"gorm.io/gorm"
 	"hawton.dev/log4g"
 )
 
-type Result struct {
-	UserResponse UserResponse
-	err          error
-}
-
-type UserResponse struct {
-	CID      string               `json:"cid"`
-	Personal UserResponsePersonal `json:"personal"`
-	Vatsim   VatsimDetails        `json:"vatsim"`
-}
-
-type UserResponsePersonal struct {
-	FirstName string `json:"name_first"`
-	LastName  string `json:"name_last"`
-	FullName  string `json:"name_full"`
-	Email     string `json:"email"`
-}
-
-type VatsimDetails struct {
-	Rating VatsimDetailsRating `json:"rating"`
-}
-
-type VatsimDetailsRating struct {
-	ID    int    `json:"id"`
-	Long  string `json:"long"`
-	Short string `json:"short"`
-}
-
-type VatsimAccessToken struct {
-	AccessToken string `json:"access_token"`
-}
-
-type VatsimResponse struct {
-	Data UserResponse `json:"data"`
-}
-
-type SSOResponse struct {
-	User *dbTypes.User `json:"user"`
-}
-
 func GetCallback(c *gin.Context) {
 	code, exists := c.GetQuery("code")
 	if !exists {
@@ -92,7 +47,7 @@ func GetCallback(c *gin.Context) {
 	}
 
 	login := dbTypes.OAuthLogin{}
-	if err = models.DB.Where("token = ? AND created_at < ?", cstate, time.Now().Add(time.Minute*5)).First(&login).Error; err != nil {
+	if err = models.DB.Where("token = ? AND expires_at > ?", cstate, time.Now()).First(&login).Error; err != nil {
 		log4g.Category("controllers/callback").Error("Token used that isn't in db, duplicate request? " + cstate)
 		handleError(c, "Token is invalid.")
 		return
@@ -107,146 +62,38 @@ func GetCallback(c *gin.Context) {
 	scheme := "https"
 	returnUri := fmt.Sprintf("%s://%s/oauth/callback", scheme, c.Request.Host)
 
-	result := make(chan Result)
-	go func() {
-		tokenUrl := fmt.Sprintf("%s%s", os.Getenv("VATSIM_BASE_URL"), os.Getenv("VATSIM_TOKEN_PATH"))
-
-		data := map[string]interface{}{
-			"grant_type":    "authorization_code",
-			"code":          code,
-			"redirect_uri":  returnUri,
-			"client_id":     atoi(os.Getenv("VATSIM_OAUTH_CLIENT_ID")),
-			"client_secret": os.Getenv("VATSIM_OAUTH_CLIENT_SECRET"),
-			"scopes":        strings.Split(os.Getenv("VATSIM_OAUTH_SCOPES"), " "),
-		}
-
-		// VATSIM wants this as an int, the RFC says string
-		if os.Getenv("VATSIM_USER_INFO_FORMAT") != "vatsim" {
-			data["client_id"] = os.Getenv("VATSIM_OAUTH_CLIENT_ID")
-		}
-
-		json_data, err := json.Marshal(data)
-		if err != nil {
-			result <- Result{err: err}
-			return
-		}
-		request, err := http.Post(tokenUrl, "application/json", bytes.NewBuffer(json_data))
-		if err != nil {
-			result <- Result{err: err}
-			return
-		}
-		defer request.Body.Close()
-		body, err := ioutil.ReadAll(request.Body)
-		if err != nil {
-			result <- Result{err: err}
-			return
-		}
-
-		if request.StatusCode > 399 {
-			result <- Result{err: fmt.Errorf("error %d received from vatsim: %s", request.StatusCode, string(body))}
-			return
-		}
-
-		accessToken := &VatsimAccessToken{}
-		if err = json.Unmarshal(body, accessToken); err != nil {
-			result <- Result{err: err}
-			return
-		}
-
-		if accessToken.AccessToken == "" {
-			result <- Result{err: fmt.Errorf("no access token received")}
-			return
-		}
-
-		userRequest, err := http.NewRequest("GET", fmt.Sprintf("%s%s", os.Getenv("VATSIM_BASE_URL"), os.Getenv("VATSIM_USER_INFO_PATH")), nil)
-		userRequest.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken.AccessToken))
-		if err != nil {
-			result <- Result{err: err}
-			return
-		}
-
-		userResponse, err := http.DefaultClient.Do(userRequest)
-		if err != nil {
-			result <- Result{err: err}
-			return
-		}
-		defer userResponse.Body.Close()
-
-		userBody, err := ioutil.ReadAll(userResponse.Body)
-		if err != nil {
-			result <- Result{err: err}
-			return
-		}
-
-		if userResponse.StatusCode > 399 {
-			result <- Result{err: fmt.Errorf("error %d received from vatsim: %s", userResponse.StatusCode, string(userBody))}
-			return
-		}
-
-		if os.Getenv("VATSIM_USER_INFO_FORMAT") == "vatsim" {
-			vatsimResponse := &VatsimResponse{}
-			if err = json.Unmarshal(userBody, vatsimResponse); err != nil {
-				result <- Result{err: err}
-				return
-			}
-
-			result <- Result{UserResponse: vatsimResponse.Data, err: err}
-		} else {
-			ssoresponse := &SSOResponse{}
-			if err = json.Unmarshal(userBody, ssoresponse); err != nil {
-				result <- Result{err: err}
-				return
-			}
-
-			resp := &VatsimResponse{
-				Data: UserResponse{
-					CID: fmt.Sprint(ssoresponse.User.CID),
-					Personal: UserResponsePersonal{
-						FirstName: ssoresponse.User.FirstName,
-						LastName:  ssoresponse.User.LastName,
-						FullName:  fmt.Sprintf("%s %s", ssoresponse.User.FirstName, ssoresponse.User.LastName),
-						Email:     ssoresponse.User.Email,
-					},
-					Vatsim: VatsimDetails{
-						Rating: VatsimDetailsRating{
-							ID:    ssoresponse.User.RatingID,
-							Short: ssoresponse.User.Rating.Short,
-							Long:  ssoresponse.User.Rating.Long,
-						},
-					},
-				},
-			}
-
-			result <- Result{UserResponse: resp.Data, err: err}
-		}
-	}()
-
-	userResult := <-result
+	accessToken, err := idp.Current.Exchange(c.Request.Context(), code, returnUri)
+	if err != nil {
+		log4g.Category("controllers/callback").Error("Error exchanging code with upstream: %s", err.Error())
+		handleError(c, "Internal Error while getting user data from VATSIM Connect")
+		return
+	}
 
-	if userResult.err != nil {
-		log4g.Category("controllers/callback").Error("Error getting user from Vatsim: %s", userResult.err.Error())
+	upstreamUser, err := idp.Current.User(c.Request.Context(), accessToken)
+	if err != nil {
+		log4g.Category("controllers/callback").Error("Error getting user from upstream: %s", err.Error())
 		handleError(c, "Internal Error while getting user data from VATSIM Connect")
 		return
 	}
 
-	log4g.Category("controllers/callback").Debug("Got user from Vatsim: %+v", userResult.UserResponse)
+	log4g.Category("controllers/callback").Debug("Got user from upstream: %+v", upstreamUser)
 	user := &dbTypes.User{}
-	if err = models.DB.Where(&dbTypes.User{CID: uint(atoi(userResult.UserResponse.CID))}).First(&user).Error; err != nil {
+	if err = models.DB.Where(&dbTypes.User{CID: upstreamUser.CID}).First(&user).Error; err != nil {
 		if errors.Is(gorm.ErrRecordNotFound, err) {
 			log4g.Category("controllers/callback").Debug("User not found in db, creating new user")
 			// @TODO: Move this to an API package when the new monolith API is written
-			go func(user UserResponse) {
+			go func(user *idp.User) {
 				rating := &dbTypes.Rating{}
-				if err := models.DB.Where(&dbTypes.Rating{ID: user.Vatsim.Rating.ID}).First(&rating).Error; err != nil {
+				if err := models.DB.Where(&dbTypes.Rating{ID: user.RatingID}).First(&rating).Error; err != nil {
 					log4g.Category("controllers/callback").Error("Error getting rating from db: %s", err.Error())
 					return
 				}
 
 				newUser := &dbTypes.User{
-					CID:                   uint(atoi(user.CID)),
-					FirstName:             user.Personal.FirstName,
-					LastName:              user.Personal.LastName,
-					Email:                 user.Personal.Email,
+					CID:                   user.CID,
+					FirstName:             user.FirstName,
+					LastName:              user.LastName,
+					Email:                 user.Email,
 					ControllerType:        dbTypes.ControllerTypeOptions["none"],
 					GndCertification:      dbTypes.CertificationOptions["none"],
 					MajorGndCertification: dbTypes.CertificationOptions["none"],
@@ -255,7 +102,7 @@ func GetCallback(c *gin.Context) {
 					AppCertification:      dbTypes.CertificationOptions["none"],
 					MajorAppCertification: dbTypes.CertificationOptions["none"],
 					CtrCertification:      dbTypes.CertificationOptions["none"],
-					RatingID:              user.Vatsim.Rating.ID,
+					RatingID:              user.RatingID,
 					Rating:                *rating,
 					Status:                dbTypes.ControllerStatusOptions["none"],
 					CreatedAt:             time.Now(),
@@ -265,7 +112,7 @@ func GetCallback(c *gin.Context) {
 					log4g.Category("controllers/callback").Error("Error creating user in db: %s", err.Error())
 					return
 				}
-			}(userResult.UserResponse)
+			}(upstreamUser)
 		} else {
 			log4g.Category("controllers/callback").Error("Error getting user from db: %s", err.Error())
 			handleError(c, "Internal Error while getting user data from VATSIM Connect")
@@ -275,14 +122,14 @@ func GetCallback(c *gin.Context) {
 
 	log4g.Category("controllers/callback").Debug("Got user from db: %+v", user)
 
-	login.CID = uint(atoi(userResult.UserResponse.CID))
+	if approveDevice(c, &login, upstreamUser.CID) {
+		return
+	}
+
+	login.CID = upstreamUser.CID
 	login.Code, _ = gonanoid.New(32)
+	login.ExpiresAt = time.Now().Add(loginpkg.AuthorizationCodeLifetime)
 	models.DB.Save(&login)
 
 	c.Redirect(302, fmt.Sprintf("%s?code=%s&state=%s", login.RedirectURI, login.Code, login.State))
 }
-
-func atoi(s string) int {
-	i, _ := strconv.Atoi(s)
-	return i
-}
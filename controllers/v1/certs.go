@@ -19,39 +19,44 @@
 package v1
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
-	"os"
+	"strings"
+	"time"
 
+	"github.com/adh-partnership/sso/pkg/tokens"
 	"github.com/gin-gonic/gin"
-	"github.com/lestrrat-go/jwx/v2/jwk"
-	"hawton.dev/log4g"
 )
 
-type certReturn struct {
-	message string
-	keys    jwk.Set
-}
+// CertsMaxAge is how long relying parties may cache the JWKS. A pending key is
+// published a whole rotation before it signs, so anything shorter than the
+// rotation interval lets them see it in time.
+var CertsMaxAge = 5 * time.Minute
 
 func GetCerts(c *gin.Context) {
-	jkeyset := os.Getenv("SSO_JWKS")
-	keyset, err := jwk.Parse([]byte(jkeyset))
-	if err != nil {
-		log4g.Category("controllers/certs").Error("Error parsing JWKs: " + err.Error())
-		log4g.Category("controllers/certs").Debug(jkeyset)
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not parse JWKs"})
+	jwks, etag := tokens.PublicJWKS()
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(CertsMaxAge.Seconds())))
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
 		return
 	}
 
-	pub, err := jwk.PublicSetOf(keyset)
-	if err != nil {
-		log4g.Category("controllers/certs").Error("Error generating public keyset: " + err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Could not generate public keyset"})
-		return
+	c.Data(http.StatusOK, "application/json", jwks)
+}
+
+// etagMatches implements the weak comparison RFC7232 3.2 asks If-None-Match
+// to use.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
 	}
-	jpub, _ := json.Marshal(pub)
-	out := map[string]interface{}{}
-	json.Unmarshal([]byte(jpub), &out)
-	out["message"] = "OK"
-	c.JSON(http.StatusOK, out)
+	return false
 }
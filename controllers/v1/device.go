@@ -0,0 +1,225 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v1
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/models"
+	loginpkg "github.com/adh-partnership/sso/pkg/login"
+	"github.com/gin-gonic/gin"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"hawton.dev/log4g"
+)
+
+type DeviceAuthorizationRequest struct {
+	loginpkg.ClientAuth
+	Scope []string `form:"scope" json:"scope"`
+}
+
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type DeviceVerifyRequest struct {
+	UserCode string `form:"user_code"`
+	Action   string `form:"action"` // Empty asks the user to confirm, then approve or deny
+	CSRF     string `form:"csrf"`
+}
+
+func PostDeviceAuthorization(c *gin.Context) {
+	req := DeviceAuthorizationRequest{}
+	if err := c.ShouldBind(&req); err != nil {
+		log4g.Category("controllers/device").Error("Invalid request, missing field(s): %+v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+		return
+	}
+
+	client, err := authenticateClient(c, &req.ClientAuth)
+	if err != nil {
+		log4g.Category("controllers/device").Error("Invalid client %s: %s", req.ClientID, err.Error())
+		clientAuthError(c, &req.ClientAuth, err)
+		return
+	}
+
+	settings, err := models.GetClientSettings(client.ID)
+	if err != nil {
+		log4g.Category("controllers/device").Error("Error loading settings for client %s: %s", client.ClientID, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	if !settings.AllowsGrantType(loginpkg.DeviceCodeGrantType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": loginpkg.ErrUnauthorizedClient.Error()})
+		return
+	}
+
+	scopes := loginpkg.SplitScopes(req.Scope)
+	if err := loginpkg.ValidateScopes(client, scopes); err != nil {
+		log4g.Category("controllers/device").Error("Invalid scope requested by %s: %s", client.ClientID, strings.Join(scopes, " "))
+		c.JSON(http.StatusBadRequest, gin.H{"error": loginpkg.ErrInvalidScope.Error()})
+		return
+	}
+
+	device, err := loginpkg.CreateDeviceCode(client, strings.Join(scopes, " "))
+	if err != nil {
+		log4g.Category("controllers/device").Error("Error creating device code: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	verificationUri := fmt.Sprintf("https://%s/oauth/device", c.Request.Host)
+	c.JSON(http.StatusOK, DeviceAuthorizationResponse{
+		DeviceCode:              device.DeviceCode,
+		UserCode:                device.UserCode,
+		VerificationURI:         verificationUri,
+		VerificationURIComplete: fmt.Sprintf("%s?user_code=%s", verificationUri, url.QueryEscape(device.UserCode)),
+		ExpiresIn:               int(time.Until(device.ExpiresAt).Seconds()),
+		Interval:                device.Interval,
+	})
+}
+
+func GetDevice(c *gin.Context) {
+	c.HTML(http.StatusOK, "device.html", gin.H{"user_code": c.Query("user_code")})
+}
+
+// PostDevice takes the user code entered on the verification page and asks the
+// user to confirm the device, so a code from someone else's device isn't
+// approved blindly. Once confirmed, the user goes through the normal upstream
+// login and GetCallback approves the device code when they come back.
+func PostDevice(c *gin.Context) {
+	req := DeviceVerifyRequest{}
+	if err := c.ShouldBind(&req); err != nil || req.UserCode == "" {
+		c.HTML(http.StatusBadRequest, "device.html", gin.H{"error": "Please enter the code shown on your device."})
+		return
+	}
+
+	device, err := loginpkg.FindDeviceByUserCode(req.UserCode, c.ClientIP())
+	if err == loginpkg.ErrTooManyAttempts {
+		c.HTML(http.StatusTooManyRequests, "device.html", gin.H{"error": "Too many wrong codes, please try again later."})
+		return
+	}
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "device.html", gin.H{"error": "That code is invalid or has expired.", "user_code": req.UserCode})
+		return
+	}
+
+	if req.Action == "" {
+		csrf, err := gonanoid.New(32)
+		if err != nil {
+			log4g.Category("controllers/device").Error("Error generating csrf token " + err.Error())
+			handleError(c, "Failed to generate new token.")
+			return
+		}
+		c.SetCookie("sso_device", csrf, int(loginpkg.DeviceCodeLifetime.Seconds()), "/oauth/device", c.Request.Host, false, true)
+		c.HTML(http.StatusOK, "device.html", gin.H{
+			"confirm":   true,
+			"user_code": device.UserCode,
+			"client":    device.Client.Name,
+			"scopes":    strings.Fields(device.Scope),
+			"csrf":      csrf,
+		})
+		return
+	}
+
+	if cookie, err := c.Cookie("sso_device"); err != nil || req.CSRF == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(req.CSRF)) != 1 {
+		c.HTML(http.StatusBadRequest, "device.html", gin.H{"error": "Please confirm the code again.", "user_code": req.UserCode})
+		return
+	}
+	c.SetCookie("sso_device", "", -1, "/oauth/device", c.Request.Host, false, true)
+
+	switch req.Action {
+	case "approve":
+	case "deny":
+		if err := loginpkg.DenyDevice(device); err != nil {
+			log4g.Category("controllers/device").Error("Failed to deny device code: %s", err.Error())
+			handleError(c, "Failed to deny device.")
+			return
+		}
+		c.HTML(http.StatusOK, "device.html", gin.H{"denied": true})
+		return
+	default:
+		c.HTML(http.StatusBadRequest, "device.html", gin.H{"error": "Please confirm the code again.", "user_code": req.UserCode})
+		return
+	}
+
+	token, err := gonanoid.New(32)
+	if err != nil {
+		log4g.Category("controllers/device").Error("Error generating new token " + err.Error())
+		handleError(c, "Failed to generate new token.")
+		return
+	}
+
+	login := dbTypes.OAuthLogin{
+		Token:       token,
+		UserAgent:   c.Request.UserAgent(),
+		IP:          c.ClientIP(),
+		RedirectURI: fmt.Sprintf("https://%s/oauth/device", c.Request.Host),
+		Client:      device.Client,
+		ClientID:    device.ClientID,
+		Scope:       device.Scope,
+		ExpiresAt:   time.Now().Add(loginpkg.AuthorizationCodeLifetime),
+	}
+	if err = models.DB.Create(&login).Error; err != nil {
+		log4g.Category("controllers/device").Error("Failed to store token " + err.Error())
+		handleError(c, "Failed to create token")
+		return
+	}
+
+	device.LoginToken = login.Token
+	if err = models.DB.Save(device).Error; err != nil {
+		log4g.Category("controllers/device").Error("Failed to link device code " + err.Error())
+		handleError(c, "Failed to create token")
+		return
+	}
+
+	redirectToUpstream(c, &login)
+}
+
+// approveDevice finishes a device authorization if the login was started from
+// the verification page. Returns false when the login belongs to a normal
+// authorization code flow.
+func approveDevice(c *gin.Context, login *dbTypes.OAuthLogin, cid uint) bool {
+	device := models.OAuthDeviceCode{}
+	if err := models.DB.Where("login_token = ?", login.Token).First(&device).Error; err != nil {
+		return false
+	}
+
+	device.CID = cid
+	device.Approved = true
+	if err := models.DB.Save(&device).Error; err != nil {
+		log4g.Category("controllers/device").Error("Failed to approve device code: %s", err.Error())
+		handleError(c, "Failed to approve device.")
+		return true
+	}
+	models.DB.Delete(login)
+
+	c.HTML(http.StatusOK, "device.html", gin.H{"approved": true})
+	return true
+}
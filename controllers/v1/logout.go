@@ -0,0 +1,120 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v1
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/models"
+	loginpkg "github.com/adh-partnership/sso/pkg/login"
+	"github.com/gin-gonic/gin"
+	"hawton.dev/log4g"
+)
+
+type LogoutRequest struct {
+	IDTokenHint           string `form:"id_token_hint"`
+	ClientID              string `form:"client_id"`
+	PostLogoutRedirectURI string `form:"post_logout_redirect_uri"`
+	State                 string `form:"state"`
+}
+
+// GetLogout is the OIDC RP-Initiated Logout endpoint. The SSO keeps no session
+// of its own, so logging out ends the user's grants with the client the
+// id_token_hint was issued to.
+func GetLogout(c *gin.Context) {
+	req := LogoutRequest{}
+	if err := c.ShouldBind(&req); err != nil || req.IDTokenHint == "" {
+		log4g.Category("controllers/logout").Error("Invalid request, missing field(s): %+v", err)
+		handleError(c, "Invalid Logout Request.")
+		return
+	}
+
+	hint, err := loginpkg.ParseIDTokenHint(req.IDTokenHint)
+	if err != nil || len(hint.Audience()) == 0 {
+		log4g.Category("controllers/logout").Error("Invalid id_token_hint received: %v", err)
+		handleError(c, "Invalid Logout Request.")
+		return
+	}
+
+	// ID tokens are addressed to the client's name, which isn't unique. With a
+	// client_id the hint must be addressed to that client, without one the
+	// name may only belong to a single client.
+	client := dbTypes.OAuthClient{}
+	if req.ClientID != "" {
+		if err := models.DB.Where("client_id = ?", req.ClientID).First(&client).Error; err != nil || !hasAudience(hint.Audience(), client.Name) {
+			log4g.Category("controllers/logout").Error("No client %q for id_token_hint addressed to %v", req.ClientID, hint.Audience())
+			handleError(c, "Invalid Client ID Received.")
+			return
+		}
+	} else {
+		var clients []dbTypes.OAuthClient
+		if err := models.DB.Where("name = ?", hint.Audience()[0]).Limit(2).Find(&clients).Error; err != nil || len(clients) != 1 {
+			log4g.Category("controllers/logout").Error("No single client for id_token_hint addressed to %v, found %d", hint.Audience(), len(clients))
+			handleError(c, "Invalid Client ID Received.")
+			return
+		}
+		client = clients[0]
+	}
+
+	if req.PostLogoutRedirectURI != "" {
+		if ok, _ := client.ValidURI(req.PostLogoutRedirectURI); !ok {
+			log4g.Category("controllers/logout").Error("Unauthorized post logout redirect uri received from client " + client.ClientID + ", " + req.PostLogoutRedirectURI)
+			handleError(c, "The Return URI was not authorized.")
+			return
+		}
+	}
+
+	cid, err := strconv.ParseUint(hint.Subject(), 10, 64)
+	if err != nil {
+		log4g.Category("controllers/logout").Error("Invalid subject %q in id_token_hint", hint.Subject())
+		handleError(c, "Invalid Logout Request.")
+		return
+	}
+
+	if err := loginpkg.Logout(&client, uint(cid)); err != nil {
+		log4g.Category("controllers/logout").Error("Error logging %d out of %s: %s", cid, client.ClientID, err.Error())
+		handleError(c, "Internal Server Error.")
+		return
+	}
+
+	if req.PostLogoutRedirectURI == "" {
+		c.HTML(http.StatusOK, "logout.html", gin.H{"client": client.Name})
+		return
+	}
+
+	u, _ := url.Parse(req.PostLogoutRedirectURI)
+	if req.State != "" {
+		q := u.Query()
+		q.Set("state", req.State)
+		u.RawQuery = q.Encode()
+	}
+	c.Redirect(http.StatusFound, u.String())
+}
+
+func hasAudience(aud []string, name string) bool {
+	for _, a := range aud {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
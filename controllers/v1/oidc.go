@@ -3,6 +3,10 @@ package v1
 import (
 	"net/http"
 
+	"github.com/adh-partnership/sso/database/models"
+	loginpkg "github.com/adh-partnership/sso/pkg/login"
+	"github.com/adh-partnership/sso/pkg/scopes"
+	"github.com/adh-partnership/sso/pkg/tokens"
 	"github.com/gin-gonic/gin"
 )
 
@@ -10,15 +14,28 @@ type OIDCConfig struct {
 	Issuer                                     string   `json:"issuer"`
 	AuthorizationEndpoint                      string   `json:"authorization_endpoint"`
 	TokenEndpoint                              string   `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint                string   `json:"device_authorization_endpoint"`
 	UserinfoEndpoint                           string   `json:"userinfo_endpoint"`
+	IntrospectionEndpoint                      string   `json:"introspection_endpoint"`
+	RevocationEndpoint                         string   `json:"revocation_endpoint"`
+	RegistrationEndpoint                       string   `json:"registration_endpoint"`
+	EndSessionEndpoint                         string   `json:"end_session_endpoint"`
 	JwksUri                                    string   `json:"jwks_uri"`
 	GrantTypesSupported                        []string `json:"grant_types_supported"`
 	ResponseTypesSupported                     []string `json:"response_types_supported"`
 	IdTokenSigningAlgValuesSupported           []string `json:"id_token_signing_alg_values_supported"`
+	IdTokenEncryptionAlgValuesSupported        []string `json:"id_token_encryption_alg_values_supported"`
+	IdTokenEncryptionEncValuesSupported        []string `json:"id_token_encryption_enc_values_supported"`
+	UserinfoSigningAlgValuesSupported          []string `json:"userinfo_signing_alg_values_supported"`
+	UserinfoEncryptionAlgValuesSupported       []string `json:"userinfo_encryption_alg_values_supported"`
+	UserinfoEncryptionEncValuesSupported       []string `json:"userinfo_encryption_enc_values_supported"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported"`
 	TokenEndpointAuthSigningAlgValuesSupported []string `json:"token_endpoint_auth_signing_alg_values_supported"`
 	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported"`
 	RequestParameterSupported                  bool     `json:"request_parameter_supported"`
 	RequestUriParameterSupported               bool     `json:"request_uri_parameter_supported"`
+	RequireRequestUriRegistration              bool     `json:"require_request_uri_registration"`
+	RequestObjectSigningAlgValuesSupported     []string `json:"request_object_signing_alg_values_supported"`
 	ScopesSupported                            []string `json:"scopes_supported"`
 	ClaimsSupported                            []string `json:"claims_supported"`
 }
@@ -26,32 +43,56 @@ type OIDCConfig struct {
 func GetOIDCConfig(c *gin.Context) {
 	host := c.Request.Host
 	config := OIDCConfig{
-		Issuer:                 "https://" + host,
-		AuthorizationEndpoint:  "https://" + host + "/oauth/authorize",
-		TokenEndpoint:          "https://" + host + "/oauth/token",
-		UserinfoEndpoint:       "https://" + host + "/v1/info",
-		JwksUri:                "https://" + host + "/oauth/certs",
-		GrantTypesSupported:    []string{"authorization_code"},
-		ResponseTypesSupported: []string{"code"},
-		IdTokenSigningAlgValuesSupported: []string{
-			"RS256", "ES384", "RS384", "EdDSA",
+		Issuer:                               "https://" + host,
+		AuthorizationEndpoint:                "https://" + host + "/oauth/authorize",
+		TokenEndpoint:                        "https://" + host + "/oauth/token",
+		DeviceAuthorizationEndpoint:          "https://" + host + "/oauth/device_authorization",
+		UserinfoEndpoint:                     "https://" + host + "/oauth/userinfo",
+		IntrospectionEndpoint:                "https://" + host + "/oauth/introspect",
+		RevocationEndpoint:                   "https://" + host + "/oauth/revoke",
+		RegistrationEndpoint:                 "https://" + host + "/oauth/register",
+		EndSessionEndpoint:                   "https://" + host + "/oauth/logout",
+		JwksUri:                              "https://" + host + "/oauth/certs",
+		GrantTypesSupported:                  []string{"authorization_code", "refresh_token", "client_credentials", loginpkg.DeviceCodeGrantType},
+		ResponseTypesSupported:               []string{"code"},
+		IdTokenSigningAlgValuesSupported:     tokens.Algorithms(),
+		IdTokenEncryptionAlgValuesSupported:  encryptionAlgorithms(),
+		IdTokenEncryptionEncValuesSupported:  encryptionEncodings(),
+		UserinfoSigningAlgValuesSupported:    tokens.Algorithms(),
+		UserinfoEncryptionAlgValuesSupported: encryptionAlgorithms(),
+		UserinfoEncryptionEncValuesSupported: encryptionEncodings(),
+		TokenEndpointAuthMethodsSupported: []string{
+			models.AuthMethodClientSecretBasic, models.AuthMethodClientSecretPost, models.AuthMethodClientSecretJWT, models.AuthMethodPrivateKeyJWT, models.AuthMethodNone,
 		},
 		TokenEndpointAuthSigningAlgValuesSupported: []string{
-			"RS256", "ES384", "RS384", "EdDSA",
+			"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA", "HS256", "HS384", "HS512",
 		},
 		CodeChallengeMethodsSupported: []string{"none", "S256"},
 		RequestParameterSupported:     true,
 		RequestUriParameterSupported:  true,
-		ScopesSupported:               []string{"openid", "profile", "email"},
-		ClaimsSupported: []string{
-			"sub",
-			"name",
-			"iss",
-			"exp",
-			"iat",
-			"roles",
+		RequireRequestUriRegistration: true,
+		RequestObjectSigningAlgValuesSupported: []string{
+			"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA",
 		},
+		ScopesSupported: scopes.Names(),
+		ClaimsSupported: append([]string{"iss", "aud", "exp", "iat"}, scopes.ClaimNames()...),
 	}
 
 	c.JSON(http.StatusOK, config)
 }
+
+func encryptionAlgorithms() []string {
+	var algs []string
+	for _, alg := range tokens.EncryptionAlgorithms {
+		algs = append(algs, alg.String())
+	}
+	return algs
+}
+
+func encryptionEncodings() []string {
+	var encs []string
+	for _, enc := range tokens.EncryptionEncodings {
+		encs = append(encs, enc.String())
+	}
+	return encs
+}
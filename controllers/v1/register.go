@@ -0,0 +1,110 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v1
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/adh-partnership/sso/pkg/clients"
+	"github.com/gin-gonic/gin"
+	"hawton.dev/log4g"
+)
+
+// PostRegister is the RFC7591 registration endpoint, it needs an initial
+// access token issued by an admin.
+func PostRegister(c *gin.Context) {
+	md := clients.Metadata{}
+	if err := c.ShouldBindJSON(&md); err != nil {
+		registrationError(c, clients.ErrInvalidClientMetadata)
+		return
+	}
+
+	registration, err := clients.Register(bearerToken(c), &md)
+	if err != nil {
+		registrationError(c, err)
+		return
+	}
+
+	log4g.Category("controllers/register").Info("Client %s (%s) registered", registration.ClientID, registration.ClientName)
+	registration.RegistrationClientURI = registrationClientURI(c, registration.ClientID)
+	c.JSON(http.StatusCreated, registration)
+}
+
+// GetRegistration returns a dynamically registered client, RFC7592 2.1.
+func GetRegistration(c *gin.Context) {
+	registration, err := clients.GetRegistration(c.Param("client_id"), bearerToken(c))
+	if err != nil {
+		registrationError(c, err)
+		return
+	}
+
+	registration.RegistrationClientURI = registrationClientURI(c, registration.ClientID)
+	c.JSON(http.StatusOK, registration)
+}
+
+// PutRegistration replaces the metadata of a dynamically registered client,
+// RFC7592 2.2.
+func PutRegistration(c *gin.Context) {
+	md := clients.Metadata{}
+	if err := c.ShouldBindJSON(&md); err != nil {
+		registrationError(c, clients.ErrInvalidClientMetadata)
+		return
+	}
+
+	registration, err := clients.UpdateRegistration(c.Param("client_id"), bearerToken(c), &md)
+	if err != nil {
+		registrationError(c, err)
+		return
+	}
+
+	log4g.Category("controllers/register").Info("Client %s updated its registration", registration.ClientID)
+	registration.RegistrationClientURI = registrationClientURI(c, registration.ClientID)
+	c.JSON(http.StatusOK, registration)
+}
+
+// DeleteRegistration deletes a dynamically registered client, RFC7592 2.3.
+func DeleteRegistration(c *gin.Context) {
+	if err := clients.DeleteRegistration(c.Param("client_id"), bearerToken(c)); err != nil {
+		registrationError(c, err)
+		return
+	}
+
+	log4g.Category("controllers/register").Info("Client %s deleted its registration", c.Param("client_id"))
+	c.Status(http.StatusNoContent)
+}
+
+func registrationClientURI(c *gin.Context, clientID string) string {
+	return "https://" + c.Request.Host + "/oauth/register/" + clientID
+}
+
+func registrationError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, clients.ErrInvalidToken):
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+	case errors.Is(err, clients.ErrInvalidRedirectURI):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_redirect_uri", "error_description": err.Error()})
+	case clients.IsInvalidMetadata(err):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_client_metadata", "error_description": err.Error()})
+	default:
+		log4g.Category("controllers/register").Error("Error handling client registration: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+	}
+}
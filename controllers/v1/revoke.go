@@ -0,0 +1,61 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v1
+
+import (
+	"net/http"
+
+	loginpkg "github.com/adh-partnership/sso/pkg/login"
+	"github.com/gin-gonic/gin"
+	"hawton.dev/log4g"
+)
+
+type RevokeRequest struct {
+	loginpkg.ClientAuth
+	Token         string `form:"token" json:"token"`
+	TokenTypeHint string `form:"token_type_hint" json:"token_type_hint"`
+}
+
+func PostRevoke(c *gin.Context) {
+	req := RevokeRequest{}
+	if err := c.ShouldBind(&req); err != nil || req.Token == "" {
+		log4g.Category("controllers/revoke").Error("Invalid request, missing field(s): %+v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+		return
+	}
+
+	client, err := authenticateClient(c, &req.ClientAuth)
+	if err != nil {
+		log4g.Category("controllers/revoke").Error("Invalid client %s: %s", req.ClientID, err.Error())
+		clientAuthError(c, &req.ClientAuth, err)
+		return
+	}
+
+	if err := loginpkg.Revoke(client, req.Token, req.TokenTypeHint); err != nil {
+		log4g.Category("controllers/revoke").Error("Error revoking token for %s: %s", client.ClientID, err.Error())
+		if err == loginpkg.ErrUnauthorizedClient {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
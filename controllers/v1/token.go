@@ -19,40 +19,31 @@
 package v1
 
 import (
-	"crypto/sha256"
-	"encoding/base64"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 
 	dbTypes "github.com/adh-partnership/api/pkg/database/models"
 	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/pkg/claims"
 	loginpkg "github.com/adh-partnership/sso/pkg/login"
 	"github.com/adh-partnership/sso/pkg/tokens"
 	"github.com/adh-partnership/sso/pkg/utils"
 	"github.com/gin-gonic/gin"
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"hawton.dev/log4g"
 )
 
-type TokenRequest struct {
-	GrantType    string   `form:"grant_type"`
-	ClientID     string   `form:"client_id"`
-	ClientSecret string   `form:"client_secret"`
-	Code         string   `form:"code"`
-	RedirectURI  string   `form:"redirect_uri"`
-	CodeVerifier string   `form:"code_verifier"`
-	ResponseType string   `form:"response_type"`
-	Scope        []string `form:"scope"`
-}
-
 type TokenResponse struct {
 	AccessToken         string `json:"access_token"`
 	ExpiresIn           int    `json:"expires_in"`
 	TokenType           string `json:"token_type"`
-	IdToken             string `json:"id_token"`
-	RefreshToken        string `json:"refresh_token"`
-	CodeChallenge       string `json:"code_challenge"`
-	CodeChallengeMethod string `json:"code_challenge_method"`
+	IdToken             string `json:"id_token,omitempty"`
+	RefreshToken        string `json:"refresh_token,omitempty"`
+	Scope               string `json:"scope,omitempty"`
+	CodeChallenge       string `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string `json:"code_challenge_method,omitempty"`
 }
 
 func PostToken(c *gin.Context) {
@@ -63,158 +54,240 @@ func PostToken(c *gin.Context) {
 		return
 	}
 
-	if treq.GrantType != "authorization_code" {
-		log4g.Category("controllers/token").Error("Grant type is not authorization code")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+	client, err := authenticateClient(c, &treq.ClientAuth)
+	if err != nil {
+		log4g.Category("controllers/token").Error("Client authentication failed for %s: %s", treq.ClientID, err.Error())
+		clientAuthError(c, &treq.ClientAuth, err)
 		return
 	}
 
-	login := dbTypes.OAuthLogin{}
-	if err := models.DB.Joins("Client").Where("code = ?", treq.Code).First(&login).Error; err != nil {
-		log4g.Category("controllers/token").Warning(fmt.Sprintf("Code %s not found", treq.Code))
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+	l, user, err := loginpkg.HandleGrantType(client, treq)
+	if err != nil {
+		grantError(c, &treq, err)
 		return
 	}
 
-	defer models.DB.Delete(&login)
-
-	if treq.ClientID == "" || treq.ClientSecret == "" {
-		// Not in query string, let's grab from Authorization header
-		auth := c.Request.Header.Get("Authorization")
-		if auth == "" {
-			log4g.Category("controllers/token").Error("Invalid client: no creds passed.")
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_client"})
-			return
-		}
-
-		if fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", login.Client.ClientID, login.Client.ClientSecret)))) != auth {
-			log4g.Category("controllers/token").Error("Invalid client: creds did not match.")
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_client"})
-			return
-		}
-
-		authstring := strings.Replace(auth, "Basic ", "", 1)
-		authbytes, err := base64.StdEncoding.DecodeString(authstring)
-		if err != nil {
-			log4g.Category("controllers/token").Error("Invalid client: base64 decode failed: %+v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_client"})
-			return
-		}
-		authslice := strings.SplitN(string(authbytes), ":", 2)
-		treq.ClientID = authslice[0]
-		treq.ClientSecret = authslice[1]
-	} else if treq.ClientID != login.Client.ClientID || treq.ClientSecret != login.Client.ClientSecret {
-		log4g.Category("controllers/token").Error(fmt.Sprintf("Invalid client: %s does not match %s", treq.ClientID, login.Client.ClientID))
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_client"})
+	// Client credentials don't have a user behind them
+	if user == nil {
+		issueClientToken(c, l)
 		return
 	}
 
-	if login.CodeChallengeMethod == "S256" {
-		hash := sha256.Sum256([]byte(treq.CodeVerifier))
-		if login.CodeChallenge != base64.RawURLEncoding.EncodeToString(hash[:]) {
-			log4g.Category("controllers/token").Error("Code Challenge failed")
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
-			return
-		} else {
-			auth := strings.Split(c.GetHeader("Authorization"), " ")[1]
-			authBytes, err := base64.URLEncoding.DecodeString(auth)
-			if err != nil {
-				log4g.Category("controllers/token").Error("Failed base64 decoding %s %s", c.GetHeader("Authorization"), err)
-				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
-				return
-			}
-			authslice := strings.SplitN(string(authBytes), ":", 2)
-			treq.ClientID = authslice[0]
-			treq.ClientSecret = authslice[1]
-		}
-	}
+	scopes := loginpkg.SplitScopes([]string{l.Scope})
 
-	l, user, err := loginpkg.HandleGrantType(treq)
-	if err != nil || l == nil {
-		log4g.Category("controllers/token").Error(err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	settings, err := models.GetClientSettings(l.Client.ID)
+	if err != nil {
+		log4g.Category("controllers/token").Error("Error loading settings for client %s: %s", l.Client.ClientID, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
 		return
 	}
+	lifetimes := loginpkg.LifetimesFor(&l.Client, settings)
 
-	if len(treq.Scope) == 0 {
-		treq.Scope = strings.Split(l.Scope, " ")
+	ret := TokenResponse{
+		TokenType:           "bearer",
+		ExpiresIn:           lifetimes.AccessToken,
+		Scope:               l.Scope,
+		CodeChallenge:       l.CodeChallenge,
+		CodeChallengeMethod: l.CodeChallengeMethod,
 	}
 
-	var roles []string
-	for _, role := range user.Roles {
-		roles = append(roles, role.Name)
-	}
+	accessClaims := tokens.Claims(claims.TargetAccessToken, user, scopes, settings.ClaimMappings)
+	accessClaims["client_id"] = l.Client.ClientID
+	accessClaims["scope"] = l.Scope
 
-	ret := TokenResponse{
-		TokenType: "bearer",
-		ExpiresIn: l.Client.TTL,
-	}
-	if l != nil {
-		ret.CodeChallenge = l.CodeChallenge
-		ret.CodeChallengeMethod = l.CodeChallengeMethod
+	// Issued first so a reference access token can be tied to its family
+	ret.RefreshToken, err = loginpkg.CreateRefreshToken(l, user, lifetimes)
+	if err != nil {
+		log4g.Category("controllers/token").Error("Error creating refresh token: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
 	}
 
-	var accessToken []byte
-	if strings.ToLower(l.Client.Name) != "kubernetes" {
-		accessToken, err = tokens.CreateToken(
-			utils.Getenv("SSO_ISSUERKEY", "auth.denartcc.org"),
-			l.Client.Name,
-			fmt.Sprint(l.CID),
-			l.Client.TTL,
-			map[string]interface{}{
-				"roles": roles,
-			},
-		)
-	} else {
-		accessToken, err = tokens.CreateTokenKubernetes(
-			utils.Getenv("SSO_ISSUERKEY", "auth.denartcc.org"),
-			l.Client.Name,
-			fmt.Sprint(l.CID),
-			l.Client.TTL,
-			map[string]interface{}{
-				"roles": roles,
-			},
-		)
-	}
+	ret.AccessToken, err = createAccessToken(&l.Client, settings, fmt.Sprint(l.CID), lifetimes.AccessToken, accessClaims, loginpkg.FamilyOf(ret.RefreshToken))
 	if err != nil {
 		log4g.Category("controllers/token").Error("Error creating access token: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
 		return
 	}
-	ret.AccessToken = string(accessToken)
 
-	if contains(treq.Scope, "openid") {
+	if contains(scopes, "openid") {
+		idClaims := tokens.Claims(claims.TargetIDToken, user, scopes, settings.ClaimMappings)
+		// Only present when the login came from an authorization request
+		if l.Nonce != "" {
+			idClaims["nonce"] = l.Nonce
+		}
+
 		idtoken, err := tokens.CreateToken(
+			signingAlg(settings.IDTokenSignedResponseAlg),
 			utils.Getenv("SSO_ISSUERKEY", "auth.denartcc.org"),
 			l.Client.Name,
 			fmt.Sprint(l.CID),
-			l.Client.TTL,
-			map[string]interface{}{
-				"name":        fmt.Sprintf("%s %s", user.FirstName, user.LastName),
-				"given_name":  user.FirstName,
-				"family_name": user.LastName,
-				"email":       user.Email,
-				"roles":       roles,
-				"nonce":       l.Nonce,
-			},
+			lifetimes.IDToken,
+			idClaims,
 		)
+		if err == nil && settings.IDTokenEncryptedResponseAlg != "" {
+			idtoken, err = encryptForClient(c, settings, idtoken, settings.IDTokenEncryptedResponseAlg, settings.IDTokenEncryptedResponseEnc, true)
+		}
 		if err != nil {
 			log4g.Category("controllers/token").Error("Error creating id token: %s", err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
 			return
 		}
 		ret.IdToken = string(idtoken)
 	}
-	ret.RefreshToken, _ = loginpkg.CreateRefreshToken(l, user)
 
-	_, err = loginpkg.CleanupAuthorization(treq)
+	c.JSON(http.StatusOK, ret)
+}
+
+// grantError responds to a failed grant with its RFC6749 5.2 or RFC8628 3.5
+// error code, anything else is a server error the client learns nothing of.
+func grantError(c *gin.Context, treq *loginpkg.TokenRequest, err error) {
+	log4g.Category("controllers/token").Error("%s grant failed for client %s: %s", treq.GrantType, treq.ClientID, err.Error())
+
+	switch err {
+	case loginpkg.ErrInvalidRequest, loginpkg.ErrInvalidGrant, loginpkg.ErrInvalidScope, loginpkg.ErrUnauthorizedClient, loginpkg.ErrUnsupportedGrantType,
+		loginpkg.ErrAuthorizationPending, loginpkg.ErrSlowDown, loginpkg.ErrExpiredToken, loginpkg.ErrAccessDenied:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+	}
+}
+
+// issueClientToken issues an access token to the client itself, there is no
+// user so neither an id token nor a refresh token is returned.
+func issueClientToken(c *gin.Context, l *dbTypes.OAuthLogin) {
+	settings, err := models.GetClientSettings(l.Client.ID)
 	if err != nil {
-		log4g.Category("controllers/token").Error("Error cleaning up authorization: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		log4g.Category("controllers/token").Error("Error loading settings for client %s: %s", l.Client.ClientID, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
 		return
 	}
 
-	c.JSON(http.StatusOK, ret)
+	lifetimes := loginpkg.LifetimesFor(&l.Client, settings)
+	accessToken, err := createAccessToken(&l.Client, settings, l.Client.ClientID, lifetimes.AccessToken, map[string]interface{}{
+		"client_id":             l.Client.ClientID,
+		"scope":                 l.Scope,
+		loginpkg.GrantTypeClaim: "client_credentials",
+	}, "")
+	if err != nil {
+		log4g.Category("controllers/token").Error("Error creating access token: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "bearer",
+		ExpiresIn:   lifetimes.AccessToken,
+		Scope:       l.Scope,
+	})
+}
+
+// createAccessToken issues an access token valid for ttl seconds in the format
+// the client asked for, a signed JWT or a reference to claims stored server
+// side.
+func createAccessToken(client *dbTypes.OAuthClient, settings *models.OAuthClientSettings, subject string, ttl int, tokenClaims map[string]interface{}, familyID string) (string, error) {
+	issuer := utils.Getenv("SSO_ISSUERKEY", "auth.denartcc.org")
+	if settings.AccessTokenFormat == models.AccessTokenFormatReference {
+		return loginpkg.CreateReferenceToken(client, issuer, subject, ttl, tokenClaims, familyID)
+	}
+
+	token, err := tokens.CreateAccessToken(
+		signingAlg(settings.AccessTokenSignedResponseAlg),
+		issuer,
+		client.Name,
+		subject,
+		ttl,
+		tokenClaims,
+	)
+	return string(token), err
+}
+
+// signingAlg returns the algorithm a client asked its tokens to be signed
+// with, falling back to the default.
+func signingAlg(alg string) jwa.SignatureAlgorithm {
+	if alg == "" {
+		return tokens.DefaultAlgorithm
+	}
+	return jwa.SignatureAlgorithm(alg)
+}
+
+// encryptForClient encrypts payload to one of the keys the client registered.
+func encryptForClient(c *gin.Context, settings *models.OAuthClientSettings, payload []byte, alg, enc string, nested bool) ([]byte, error) {
+	keys, err := loginpkg.ClientKeys(c.Request.Context(), settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens.Encrypt(payload, keys, alg, enc, nested)
+}
+
+// authenticateClient authenticates the client by whichever method it used on
+// the request.
+func authenticateClient(c *gin.Context, auth *loginpkg.ClientAuth) (*dbTypes.OAuthClient, error) {
+	clientCredentialsFromHeader(c, auth)
+	return loginpkg.Authenticate(c.Request.Context(), *auth, assertionAudiences())
+}
+
+// clientAuthError responds to a failed client authentication, RFC6749 5.2
+// wants a 401 with a challenge when the client used the Authorization header.
+func clientAuthError(c *gin.Context, auth *loginpkg.ClientAuth, err error) {
+	switch err {
+	case loginpkg.ErrInvalidRequest:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case loginpkg.ErrInvalidClient:
+		if auth.Basic {
+			c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+	}
+}
+
+// assertionAudiences are the audiences a client assertion may be addressed
+// to, RFC7523 allows both the issuer and the token endpoint. They come from
+// the configuration, the Host header is up to whoever sends the request.
+func assertionAudiences() []string {
+	issuer := utils.Getenv("SSO_ISSUERKEY", "auth.denartcc.org")
+	return []string{
+		issuer,
+		issuerURL(),
+		utils.Getenv("SSO_TOKEN_ENDPOINT", issuerURL()+"/oauth/token"),
+	}
+}
+
+// issuerURL is the issuer as an https URL, SSO_ISSUERKEY may be a bare host.
+func issuerURL() string {
+	issuer := strings.TrimSuffix(utils.Getenv("SSO_ISSUERKEY", "auth.denartcc.org"), "/")
+	if !strings.Contains(issuer, "://") {
+		issuer = "https://" + issuer
+	}
+	return issuer
+}
+
+// clientCredentialsFromHeader fills in the client credentials from an HTTP
+// Basic Authorization header when they were not passed in the body.
+func clientCredentialsFromHeader(c *gin.Context, auth *loginpkg.ClientAuth) {
+	if auth.ClientID != "" && auth.ClientSecret != "" {
+		return
+	}
+
+	id, secret, ok := c.Request.BasicAuth()
+	if !ok {
+		return
+	}
+
+	// RFC6749 2.3.1 says both are form encoded before being put in the header
+	if unescaped, err := url.QueryUnescape(id); err == nil {
+		id = unescaped
+	}
+	if unescaped, err := url.QueryUnescape(secret); err == nil {
+		secret = unescaped
+	}
+	auth.ClientID = id
+	auth.ClientSecret = secret
+	auth.Basic = true
 }
 
 func contains(s []string, e string) bool {
@@ -0,0 +1,65 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	loginpkg "github.com/adh-partnership/sso/pkg/login"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestGrantError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		err        error
+		wantStatus int
+		wantError  string
+	}{
+		{err: loginpkg.ErrInvalidRequest, wantStatus: http.StatusBadRequest, wantError: "invalid_request"},
+		{err: loginpkg.ErrInvalidGrant, wantStatus: http.StatusBadRequest, wantError: "invalid_grant"},
+		{err: loginpkg.ErrInvalidScope, wantStatus: http.StatusBadRequest, wantError: "invalid_scope"},
+		{err: loginpkg.ErrUnauthorizedClient, wantStatus: http.StatusBadRequest, wantError: "unauthorized_client"},
+		{err: loginpkg.ErrUnsupportedGrantType, wantStatus: http.StatusBadRequest, wantError: "unsupported_grant_type"},
+		{err: loginpkg.ErrAuthorizationPending, wantStatus: http.StatusBadRequest, wantError: "authorization_pending"},
+		{err: loginpkg.ErrSlowDown, wantStatus: http.StatusBadRequest, wantError: "slow_down"},
+		{err: loginpkg.ErrExpiredToken, wantStatus: http.StatusBadRequest, wantError: "expired_token"},
+		{err: loginpkg.ErrAccessDenied, wantStatus: http.StatusBadRequest, wantError: "access_denied"},
+		{err: gorm.ErrRecordNotFound, wantStatus: http.StatusInternalServerError, wantError: "server_error"},
+		{err: errors.New("Error 1146: Table 'sso.o_auth_client_settings' doesn't exist"), wantStatus: http.StatusInternalServerError, wantError: "server_error"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		grantError(c, &loginpkg.TokenRequest{GrantType: "authorization_code"}, tt.err)
+
+		body := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != tt.wantStatus || len(body) != 1 || body["error"] != tt.wantError {
+			t.Errorf("%v: expected %d %s, got %d: %s", tt.err, tt.wantStatus, tt.wantError, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/pkg/claims"
+	loginpkg "github.com/adh-partnership/sso/pkg/login"
+	"github.com/adh-partnership/sso/pkg/tokens"
+	"github.com/adh-partnership/sso/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+	"hawton.dev/log4g"
+)
+
+// GetUserInfo is the OIDC UserInfo endpoint, it answers both GET and POST.
+// Only the claims unlocked by the access token's scopes are returned.
+func GetUserInfo(c *gin.Context) {
+	accessToken := bearerToken(c)
+	if accessToken == "" {
+		// RFC6750 3.1, no error code when the request had no credentials at all
+		c.Header("WWW-Authenticate", `Bearer realm="userinfo"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_request"})
+		return
+	}
+
+	token, err := loginpkg.ResolveAccessToken(accessToken)
+	if err != nil {
+		userInfoError(c, http.StatusUnauthorized, "invalid_token", "The access token is invalid or expired")
+		return
+	}
+
+	cid, err := strconv.ParseUint(token.Subject, 10, 32)
+	if err != nil {
+		userInfoError(c, http.StatusUnauthorized, "invalid_token", "The access token does not belong to a user")
+		return
+	}
+
+	scopes := token.Scopes()
+	if !contains(scopes, "openid") {
+		userInfoError(c, http.StatusForbidden, "insufficient_scope", "The openid scope is required")
+		return
+	}
+
+	user := dbTypes.User{}
+	if err := models.DB.Preload(clause.Associations).Where(dbTypes.User{CID: uint(cid)}).First(&user).Error; err != nil {
+		log4g.Category("controllers/userinfo").Warning("No user found for %d: %s", cid, err.Error())
+		userInfoError(c, http.StatusUnauthorized, "invalid_token", "The access token does not belong to a user")
+		return
+	}
+
+	client := dbTypes.OAuthClient{}
+	if token.ClientID == "" || models.DB.Where("client_id = ?", token.ClientID).First(&client).Error != nil {
+		c.JSON(http.StatusOK, tokens.UserClaims(&user, scopes))
+		return
+	}
+	settings, err := models.GetClientSettings(client.ID)
+	if err != nil {
+		log4g.Category("controllers/userinfo").Error("Error loading settings for client %s: %s", client.ClientID, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	userClaims := tokens.Claims(claims.TargetUserinfo, &user, scopes, settings.ClaimMappings)
+	if settings.UserinfoSignedResponseAlg == "" && settings.UserinfoEncryptedResponseAlg == "" {
+		c.JSON(http.StatusOK, userClaims)
+		return
+	}
+
+	// OIDC Core 5.3.2, signed and/or encrypted responses are JWTs
+	var body []byte
+	if settings.UserinfoSignedResponseAlg != "" {
+		body, err = tokens.CreateToken(
+			signingAlg(settings.UserinfoSignedResponseAlg),
+			utils.Getenv("SSO_ISSUERKEY", "auth.denartcc.org"),
+			client.Name,
+			token.Subject,
+			loginpkg.LifetimesFor(&client, settings).IDToken,
+			userClaims,
+		)
+	} else {
+		body, err = json.Marshal(userClaims)
+	}
+	if err == nil && settings.UserinfoEncryptedResponseAlg != "" {
+		body, err = encryptForClient(c, settings, body, settings.UserinfoEncryptedResponseAlg, settings.UserinfoEncryptedResponseEnc, settings.UserinfoSignedResponseAlg != "")
+	}
+	if err != nil {
+		log4g.Category("controllers/userinfo").Error("Error creating userinfo response for client %s: %s", client.ClientID, err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/jwt", body)
+}
+
+// bearerToken gets the access token from the Authorization header or, for form
+// encoded POSTs, the access_token body parameter (RFC6750 2.1 and 2.2).
+func bearerToken(c *gin.Context) string {
+	const BEARER_SCHEMA = "Bearer "
+	authHeader := c.GetHeader("Authorization")
+	if len(authHeader) > len(BEARER_SCHEMA) && strings.EqualFold(authHeader[:len(BEARER_SCHEMA)], BEARER_SCHEMA) {
+		return authHeader[len(BEARER_SCHEMA):]
+	}
+
+	if c.Request.Method == http.MethodPost {
+		return c.PostForm("access_token")
+	}
+
+	return ""
+}
+
+func userInfoError(c *gin.Context, status int, code, description string) {
+	c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="%s", error_description="%s"`, code, description))
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
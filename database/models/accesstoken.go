@@ -0,0 +1,37 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package models
+
+import "time"
+
+// OAuthAccessToken is a reference access token. The client only gets an opaque
+// handle, the claims stay here so the token can be deleted before it expires.
+// Like refresh tokens only a hash of the handle is kept.
+type OAuthAccessToken struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	TokenHash string    `json:"-" gorm:"type:varchar(64);uniqueIndex"`
+	ClientID  string    `json:"client_id" gorm:"type:varchar(128);index"`
+	Subject   string    `json:"sub" gorm:"type:varchar(128)"`
+	Issuer    string    `json:"iss" gorm:"type:varchar(255)"`
+	Audience  string    `json:"aud" gorm:"type:varchar(255)"`
+	Claims    string    `json:"claims" gorm:"type:text"`
+	FamilyID  string    `json:"family_id" gorm:"type:varchar(64);index"` // Refresh token family it was issued with, if any
+	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,31 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package models
+
+import "time"
+
+// OAuthClientAssertion remembers the jti of every client assertion JWT until
+// it expires, so a captured assertion can't be replayed (RFC7523 3).
+type OAuthClientAssertion struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	ClientID  string    `json:"client_id" gorm:"type:varchar(128);uniqueIndex:idx_client_assertion_jti"`
+	JTI       string    `json:"jti" gorm:"type:varchar(255);uniqueIndex:idx_client_assertion_jti"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,31 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package models
+
+import "time"
+
+// OAuthClientAudit records every change made to a client and who made it.
+type OAuthClientAudit struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	ClientID  uint      `json:"client_id" gorm:"index"`
+	Action    string    `json:"action" gorm:"type:varchar(32)"`
+	CID       uint      `json:"cid"`                      // The acting user, 0 when the client did it itself
+	Changes   string    `json:"changes" gorm:"type:text"` // The client after the change, as JSON
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,191 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/adh-partnership/sso/database/datatypes"
+	"github.com/adh-partnership/sso/pkg/claims"
+	"gorm.io/gorm"
+)
+
+// OAuthClientSettings holds the SSO specific settings of a dbTypes.OAuthClient,
+// the client table itself is shared with the API so it is kept separate.
+type OAuthClientSettings struct {
+	ID                           uint              `json:"id" gorm:"primaryKey"`
+	ClientID                     uint              `json:"-" gorm:"uniqueIndex"`
+	AllowedScopes                datatypes.JSONMap `json:"allowed_scopes"`                                           // AllScopes allows every registered scope, empty only allows openid
+	IDTokenSignedResponseAlg     string            `json:"id_token_signed_response_alg" gorm:"type:varchar(16)"`     // Empty uses tokens.DefaultAlgorithm
+	AccessTokenSignedResponseAlg string            `json:"access_token_signed_response_alg" gorm:"type:varchar(16)"` // Empty uses tokens.DefaultAlgorithm
+	IDTokenEncryptedResponseAlg  string            `json:"id_token_encrypted_response_alg" gorm:"type:varchar(32)"`  // Empty doesn't encrypt
+	IDTokenEncryptedResponseEnc  string            `json:"id_token_encrypted_response_enc" gorm:"type:varchar(32)"`  // Empty uses tokens.DefaultEncryption
+	UserinfoSignedResponseAlg    string            `json:"userinfo_signed_response_alg" gorm:"type:varchar(16)"`     // Empty returns plain JSON
+	UserinfoEncryptedResponseAlg string            `json:"userinfo_encrypted_response_alg" gorm:"type:varchar(32)"`  // Empty doesn't encrypt
+	UserinfoEncryptedResponseEnc string            `json:"userinfo_encrypted_response_enc" gorm:"type:varchar(32)"`  // Empty uses tokens.DefaultEncryption
+	JWKS                         string            `json:"jwks" gorm:"type:text"`                                    // The client's public keys, inline
+	JWKSURI                      string            `json:"jwks_uri" gorm:"type:varchar(255)"`                        // or where to fetch them
+	ClaimMappings                claims.Mappings   `json:"claim_mappings" gorm:"type:text"`
+	AccessTokenFormat            string            `json:"access_token_format" gorm:"type:varchar(16)"`        // Empty is AccessTokenFormatJWT
+	RequestURIs                  datatypes.JSONMap `json:"request_uris"`                                       // https prefixes request_uri may point at
+	TokenEndpointAuthMethod      string            `json:"token_endpoint_auth_method" gorm:"type:varchar(32)"` // Empty allows client_secret_basic and client_secret_post
+	GrantTypes                   datatypes.JSONMap `json:"grant_types"`                                        // Empty allows DefaultGrantTypes
+	ClientType                   string            `json:"client_type" gorm:"type:varchar(16)"`                // Empty is ClientTypeConfidential
+	RequirePKCE                  bool              `json:"require_pkce"`                                       // Always true for public clients
+	AccessTokenLifetime          int               `json:"access_token_lifetime"`                              // Seconds, 0 uses the client's TTL
+	IDTokenLifetime              int               `json:"id_token_lifetime"`                                  // Seconds, 0 uses the client's TTL
+	RefreshTokenIdleLifetime     int               `json:"refresh_token_idle_lifetime"`                        // Seconds a refresh token may go unused, 0 uses the default
+	RefreshTokenAbsoluteLifetime int               `json:"refresh_token_absolute_lifetime"`                    // Seconds before the user must log in again, 0 uses the default
+	CreatedAt                    time.Time         `json:"created_at"`
+	UpdatedAt                    time.Time         `json:"updated_at"`
+}
+
+const (
+	AccessTokenFormatJWT       = "jwt"       // Self-contained, valid until it expires
+	AccessTokenFormatReference = "reference" // Opaque handle to an OAuthAccessToken
+)
+
+// AllScopes in AllowedScopes allows every registered scope
+const AllScopes = "*"
+
+// How a client authenticates to the token endpoint
+const (
+	AuthMethodClientSecretBasic = "client_secret_basic"
+	AuthMethodClientSecretPost  = "client_secret_post"
+	AuthMethodClientSecretJWT   = "client_secret_jwt"
+	AuthMethodPrivateKeyJWT     = "private_key_jwt"
+	AuthMethodNone              = "none" // Public clients, PKCE stands in for the secret
+)
+
+const (
+	ClientTypeConfidential = "confidential"
+	ClientTypePublic       = "public" // Can't keep a secret, like SPAs and mobile apps
+)
+
+// Grant types a client can be limited to
+var GrantTypes = []string{"authorization_code", "refresh_token", "client_credentials", "urn:ietf:params:oauth:grant-type:device_code"}
+
+// DefaultGrantTypes are what a client without grant types may use, any other
+// grant has to be given to it
+var DefaultGrantTypes = []string{"authorization_code", "refresh_token"}
+
+var (
+	ErrInvalidAccessTokenFormat = errors.New("access_token_format must be jwt or reference")
+	ErrInvalidAuthMethod        = errors.New("unsupported token_endpoint_auth_method")
+	ErrInvalidGrantType         = errors.New("unsupported grant_type")
+	ErrInvalidLifetime          = errors.New("token lifetimes can't be negative")
+	ErrInvalidClientType        = errors.New("client_type must be confidential or public, public clients authenticate with none")
+	ErrPublicClientCredentials  = errors.New("public clients can't use the client_credentials grant")
+)
+
+func (s *OAuthClientSettings) BeforeSave(tx *gorm.DB) error {
+	switch s.AccessTokenFormat {
+	case "", AccessTokenFormatJWT, AccessTokenFormatReference:
+	default:
+		return ErrInvalidAccessTokenFormat
+	}
+
+	switch s.TokenEndpointAuthMethod {
+	case "", AuthMethodClientSecretBasic, AuthMethodClientSecretPost, AuthMethodClientSecretJWT, AuthMethodPrivateKeyJWT, AuthMethodNone:
+	default:
+		return ErrInvalidAuthMethod
+	}
+
+	// A public client and the none method always go together
+	switch s.ClientType {
+	case "":
+		if s.TokenEndpointAuthMethod == AuthMethodNone {
+			s.ClientType = ClientTypePublic
+		}
+	case ClientTypeConfidential:
+	case ClientTypePublic:
+		if s.TokenEndpointAuthMethod == "" {
+			s.TokenEndpointAuthMethod = AuthMethodNone
+		}
+	default:
+		return ErrInvalidClientType
+	}
+	if (s.ClientType == ClientTypePublic) != (s.TokenEndpointAuthMethod == AuthMethodNone) {
+		return ErrInvalidClientType
+	}
+	if s.IsPublic() && contains(s.GrantTypes, "client_credentials") {
+		return ErrPublicClientCredentials
+	}
+
+	if s.AccessTokenLifetime < 0 || s.IDTokenLifetime < 0 || s.RefreshTokenIdleLifetime < 0 || s.RefreshTokenAbsoluteLifetime < 0 {
+		return ErrInvalidLifetime
+	}
+
+	for _, grantType := range s.GrantTypes {
+		if !contains(GrantTypes, grantType) {
+			return ErrInvalidGrantType
+		}
+	}
+
+	return s.ClaimMappings.Validate()
+}
+
+// IsPublic reports whether the client is a public client.
+func (s *OAuthClientSettings) IsPublic() bool {
+	return s.ClientType == ClientTypePublic || s.TokenEndpointAuthMethod == AuthMethodNone
+}
+
+// RequiresPKCE reports whether the client's authorization requests must use PKCE.
+func (s *OAuthClientSettings) RequiresPKCE() bool {
+	return s.RequirePKCE || s.IsPublic()
+}
+
+// AllowsScope reports whether the client may request scope.
+func (s *OAuthClientSettings) AllowsScope(scope string) bool {
+	if len(s.AllowedScopes) == 0 {
+		return scope == "openid"
+	}
+	return contains(s.AllowedScopes, AllScopes) || contains(s.AllowedScopes, scope)
+}
+
+// AllowsGrantType reports whether the client may use grantType.
+func (s *OAuthClientSettings) AllowsGrantType(grantType string) bool {
+	if len(s.GrantTypes) == 0 {
+		return contains(DefaultGrantTypes, grantType)
+	}
+	return contains(s.GrantTypes, grantType)
+}
+
+// GetClientSettings returns the settings for the client, clients that were
+// never configured get the defaults.
+func GetClientSettings(clientID uint) (*OAuthClientSettings, error) {
+	settings := OAuthClientSettings{}
+	if err := DB.Where("client_id = ?", clientID).First(&settings).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &OAuthClientSettings{ClientID: clientID}, nil
+		}
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package models
+
+import (
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+)
+
+// OAuthDeviceCode tracks a pending RFC8628 device authorization. The device polls
+// with DeviceCode while the user enters UserCode on the verification page.
+type OAuthDeviceCode struct {
+	ID           uint                `json:"id" gorm:"primaryKey"`
+	DeviceCode   string              `json:"-" gorm:"type:varchar(64);uniqueIndex"`
+	UserCode     string              `json:"user_code" gorm:"type:varchar(16);uniqueIndex"`
+	LoginToken   string              `json:"-" gorm:"type:varchar(128);index"` // Token of the OAuthLogin the user is authenticating with
+	ClientID     uint                `json:"-"`
+	Client       dbTypes.OAuthClient `json:"-"`
+	Scope        string              `json:"scope"`
+	CID          uint                `json:"cid"`
+	Approved     bool                `json:"approved"`
+	Denied       bool                `json:"denied"`
+	Interval     int                 `json:"interval"` // Minimum seconds between polls
+	LastPolledAt *time.Time          `json:"last_polled_at"`
+	ExpiresAt    time.Time           `json:"expires_at"`
+	CreatedAt    time.Time           `json:"created_at"`
+	UpdatedAt    time.Time           `json:"updated_at"`
+}
+
+// OAuthDeviceAttempt is a wrong user code entered from IP, used to limit
+// guessing.
+type OAuthDeviceAttempt struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	IP        string    `json:"ip" gorm:"type:varchar(64);index"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
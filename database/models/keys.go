@@ -0,0 +1,43 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package models
+
+import "time"
+
+const (
+	KeyStatePending  = "pending"  // Published so relying parties can fetch it ahead of time
+	KeyStateActive   = "active"   // Used to sign new tokens
+	KeyStateRetiring = "retiring" // No longer signs but still published until its tokens expire
+	KeyStateRetired  = "retired"  // Unpublished, private material is wiped
+)
+
+// SigningKey is a private JWK used to sign tokens and where it is in the
+// rotation lifecycle.
+type SigningKey struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	KID         string     `json:"kid" gorm:"type:varchar(64);uniqueIndex"`
+	Algorithm   string     `json:"alg" gorm:"type:varchar(16)"`
+	State       string     `json:"state" gorm:"type:varchar(16);index"`
+	PrivateJWK  string     `json:"-" gorm:"type:text"` // Encrypted with keys.KEK when one is set
+	ActivatedAt *time.Time `json:"activated_at"`
+	RetiringAt  *time.Time `json:"retiring_at"`
+	RetiredAt   *time.Time `json:"retired_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
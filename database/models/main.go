@@ -25,6 +25,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	dbTypes "github.com/adh-partnership/api/pkg/database/models"
@@ -151,7 +152,28 @@ func Connect(options DBOptions) error {
 	sqlDB.SetMaxIdleConns(options.MaxIdleConns)
 	sqlDB.SetConnMaxIdleTime(time.Minute * 5)
 
-	DB.AutoMigrate(&dbTypes.OAuthClient{}, &dbTypes.OAuthLogin{}, &dbTypes.Rating{}, &dbTypes.Role{}, &dbTypes.User{})
+	return Migrate()
+}
 
-	return nil
+// Migrate creates or updates every table the SSO uses on DB.
+func Migrate() error {
+	if err := DB.AutoMigrate(&dbTypes.OAuthClient{}, &dbTypes.OAuthLogin{}, &dbTypes.Rating{}, &dbTypes.Role{}, &dbTypes.User{}); err != nil {
+		return err
+	}
+
+	if err := DB.AutoMigrate(&OAuthClientSettings{}, &OAuthDeviceCode{}, &OAuthDeviceAttempt{}, &OAuthRevokedToken{}, &OAuthRefreshFamily{}, &OAuthRefreshToken{}, &OAuthAccessToken{}, &OAuthClientAssertion{}, &OAuthClientAudit{}, &OAuthInitialAccessToken{}, &OAuthClientRegistration{}, &OAuthClientSecret{}, &SigningKey{}, &OAuthMigration{}); err != nil {
+		return err
+	}
+
+	return runDataMigrations()
+}
+
+// IsDuplicateKey reports whether err is a unique constraint violation.
+func IsDuplicateKey(err error) bool {
+	var mysqlErr *gomysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1062
+	}
+	// SQLite, which the tests run on, only says so in the message
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
 }
@@ -0,0 +1,130 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package models
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/datatypes"
+	"gorm.io/gorm"
+)
+
+// OAuthMigration records a data migration that has run, each one only ever
+// runs once.
+type OAuthMigration struct {
+	Name      string    `json:"name" gorm:"primaryKey;type:varchar(64)"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// dataMigrations run in order after the tables are up to date.
+var dataMigrations = []struct {
+	name string
+	run  func(tx *gorm.DB) error
+}{
+	{name: "explicit_allowed_scopes", run: explicitAllowedScopes},
+}
+
+var errMigrated = errors.New("already migrated")
+
+func runDataMigrations() error {
+	for _, migration := range dataMigrations {
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			// Replicas starting together wait on the row, only one runs it
+			if err := tx.Create(&OAuthMigration{Name: migration.name}).Error; err != nil {
+				if IsDuplicateKey(err) {
+					return errMigrated
+				}
+				return err
+			}
+			log.Info("Running data migration %s", migration.name)
+			return migration.run(tx)
+		})
+		if err != nil && err != errMigrated {
+			return err
+		}
+	}
+	return nil
+}
+
+// explicitAllowedScopes gives clients from before allowed scopes the scopes
+// their stored logins were granted, so an empty list can mean openid only.
+// Clients without any logins keep every scope.
+func explicitAllowedScopes(tx *gorm.DB) error {
+	var clients []dbTypes.OAuthClient
+	if err := tx.Find(&clients).Error; err != nil {
+		return err
+	}
+
+	for _, client := range clients {
+		settings := OAuthClientSettings{}
+		err := tx.Where("client_id = ?", client.ID).First(&settings).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if len(settings.AllowedScopes) > 0 {
+			continue
+		}
+
+		var granted []string
+		if err := tx.Model(&dbTypes.OAuthLogin{}).Where("client_id = ?", client.ID).Distinct().Pluck("scope", &granted).Error; err != nil {
+			return err
+		}
+		allowed := usedScopes(granted)
+		log.Info("Allowing client %s (%d) the scopes %s", client.ClientID, client.ID, strings.Join(allowed, " "))
+
+		if settings.ID == 0 {
+			settings.ClientID = client.ID
+			settings.AllowedScopes = datatypes.JSONMap(allowed)
+			err = tx.Create(&settings).Error
+		} else {
+			err = tx.Model(&settings).UpdateColumn("allowed_scopes", datatypes.JSONMap(allowed)).Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// usedScopes is every scope in granted, openid always included. Without
+// anything granted every scope stays allowed.
+func usedScopes(granted []string) []string {
+	if len(granted) == 0 {
+		return []string{AllScopes}
+	}
+
+	seen := map[string]bool{"openid": true}
+	for _, scope := range granted {
+		for _, name := range strings.Fields(scope) {
+			seen[name] = true
+		}
+	}
+
+	ret := []string{}
+	for name := range seen {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
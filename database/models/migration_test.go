@@ -0,0 +1,100 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package models_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/datatypes"
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/database/models/modelstest"
+)
+
+func TestExplicitAllowedScopes(t *testing.T) {
+	modelstest.Setup(t)
+	// Setup already migrated an empty database, run it again with clients in it
+	if err := models.DB.Where("1 = 1").Delete(&models.OAuthMigration{}).Error; err != nil {
+		t.Fatalf("resetting migrations: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		logins   []string
+		settings *models.OAuthClientSettings
+		want     []string
+	}{
+		{name: "used scopes", logins: []string{"openid email", "profile", "openid email"}, want: []string{"email", "openid", "profile"}},
+		{name: "used scopes with settings", logins: []string{"openid roles"}, settings: &models.OAuthClientSettings{AccessTokenFormat: models.AccessTokenFormatReference}, want: []string{"openid", "roles"}},
+		{name: "never used", want: []string{models.AllScopes}},
+		{name: "already explicit", logins: []string{"openid email"}, settings: &models.OAuthClientSettings{AllowedScopes: datatypes.JSONMap{"openid"}}, want: []string{"openid"}},
+	}
+
+	for i, tt := range tests {
+		client := dbTypes.OAuthClient{Name: tt.name, ClientID: fmt.Sprintf("client-%d", i)}
+		if err := models.DB.Create(&client).Error; err != nil {
+			t.Fatalf("creating client: %s", err)
+		}
+		for j, scope := range tt.logins {
+			if err := models.DB.Create(&dbTypes.OAuthLogin{ClientID: client.ID, Token: fmt.Sprintf("%d-%d", i, j), Scope: scope, ExpiresAt: time.Now()}).Error; err != nil {
+				t.Fatalf("creating login: %s", err)
+			}
+		}
+		if tt.settings != nil {
+			tt.settings.ClientID = client.ID
+			if err := models.DB.Create(tt.settings).Error; err != nil {
+				t.Fatalf("creating settings: %s", err)
+			}
+		}
+	}
+
+	if err := models.Migrate(); err != nil {
+		t.Fatalf("migrating: %s", err)
+	}
+
+	for i, tt := range tests {
+		client := dbTypes.OAuthClient{}
+		models.DB.Where("client_id = ?", fmt.Sprintf("client-%d", i)).First(&client)
+		settings, err := models.GetClientSettings(client.ID)
+		if err != nil {
+			t.Fatalf("%s: loading settings: %s", tt.name, err)
+		}
+		if fmt.Sprint(settings.AllowedScopes) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, settings.AllowedScopes)
+		}
+		if tt.settings != nil && settings.AccessTokenFormat != tt.settings.AccessTokenFormat {
+			t.Errorf("%s: expected the other settings to be kept, got %+v", tt.name, settings)
+		}
+	}
+
+	// It only runs once, clients from now on get openid without allowed scopes
+	client := dbTypes.OAuthClient{Name: "new", ClientID: "new"}
+	if err := models.DB.Create(&client).Error; err != nil {
+		t.Fatalf("creating client: %s", err)
+	}
+	if err := models.Migrate(); err != nil {
+		t.Fatalf("migrating again: %s", err)
+	}
+	settings, _ := models.GetClientSettings(client.ID)
+	if len(settings.AllowedScopes) != 0 || !settings.AllowsScope("openid") || settings.AllowsScope("email") {
+		t.Errorf("expected a new client to only be allowed openid, got %v", settings.AllowedScopes)
+	}
+}
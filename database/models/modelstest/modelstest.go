@@ -0,0 +1,52 @@
+// Package modelstest points models.DB at a throwaway SQLite database so tests
+// can run without MySQL.
+package modelstest
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/adh-partnership/sso/database/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var databases uint64
+
+// Setup opens an empty, fully migrated in-memory database and makes it
+// models.DB until the test finishes.
+func Setup(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	// Every connection of a shared cache database sees the same tables, and
+	// the database is gone once the last one closes
+	name := fmt.Sprintf("file:modelstest%d?mode=memory&cache=shared", atomic.AddUint64(&databases, 1))
+	db, err := gorm.Open(sqlite.Open(name), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("opening database: %s", err)
+	}
+
+	prev := models.DB
+	t.Cleanup(func() {
+		models.DB = prev
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	models.DB = db
+
+	// The shared client table has an (id, name) primary key, MySQL still auto
+	// increments id but SQLite only does that for a lone integer primary key
+	if err := db.Exec("CREATE TABLE o_auth_clients (id integer PRIMARY KEY AUTOINCREMENT, name text)").Error; err != nil {
+		t.Fatalf("creating client table: %s", err)
+	}
+	if err := models.Migrate(); err != nil {
+		t.Fatalf("migrating database: %s", err)
+	}
+
+	return db
+}
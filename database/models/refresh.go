@@ -0,0 +1,46 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package models
+
+import "time"
+
+// OAuthRefreshFamily groups every refresh token rotated out of the same
+// original login. The family has an absolute lifetime no matter how often its
+// tokens are rotated.
+type OAuthRefreshFamily struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	FamilyID  string     `json:"family_id" gorm:"type:varchar(64);uniqueIndex"`
+	ClientID  uint       `json:"client_id"`
+	CID       uint       `json:"cid"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// OAuthRefreshToken is the history of refresh tokens issued in a family. Only
+// a hash of the token is kept, the usable token is the OAuthLogin row LoginID.
+type OAuthRefreshToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	TokenHash string     `json:"-" gorm:"type:varchar(64);uniqueIndex"`
+	FamilyID  string     `json:"family_id" gorm:"type:varchar(64);index"`
+	LoginID   uint       `json:"login_id"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
@@ -0,0 +1,44 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package models
+
+import "time"
+
+// OAuthInitialAccessToken lets whoever holds it register clients through the
+// RFC7591 registration endpoint until it expires. Only a hash is kept.
+type OAuthInitialAccessToken struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	TokenHash   string    `json:"-" gorm:"type:varchar(64);uniqueIndex"`
+	Description string    `json:"description" gorm:"type:varchar(255)"`
+	CID         uint      `json:"cid"` // The admin who issued it
+	ExpiresAt   time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// OAuthClientRegistration is the RFC7592 registration access token of a
+// dynamically registered client. Only a hash is kept.
+type OAuthClientRegistration struct {
+	ID                   uint      `json:"id" gorm:"primaryKey"`
+	ClientID             uint      `json:"client_id" gorm:"uniqueIndex"`
+	TokenHash            string    `json:"-" gorm:"type:varchar(64);uniqueIndex"`
+	InitialAccessTokenID uint      `json:"initial_access_token_id"`
+	CID                  uint      `json:"cid"` // The admin who issued the initial access token, changes are audited as theirs
+	CreatedAt            time.Time `json:"created_at"`
+	UpdatedAt            time.Time `json:"updated_at"`
+}
@@ -0,0 +1,34 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package models
+
+import "time"
+
+// OAuthClientSecret holds the expiry of a client's current secret and, while
+// it is being rotated, the secret it replaced. The current secret itself stays
+// on dbTypes.OAuthClient.
+type OAuthClientSecret struct {
+	ID                uint       `json:"id" gorm:"primaryKey"`
+	ClientID          uint       `json:"client_id" gorm:"uniqueIndex"`
+	ExpiresAt         *time.Time `json:"expires_at"`                 // Nil never expires
+	Previous          string     `json:"-" gorm:"type:varchar(255)"` // Hashed like the current secret
+	PreviousExpiresAt *time.Time `json:"previous_expires_at" gorm:"index"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
@@ -0,0 +1,1481 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/datatypes"
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/database/models/modelstest"
+	"github.com/adh-partnership/sso/database/seed"
+	"github.com/adh-partnership/sso/pkg/claims"
+	"github.com/adh-partnership/sso/pkg/clients"
+	"github.com/adh-partnership/sso/pkg/idp"
+	"github.com/adh-partnership/sso/pkg/idp/idptest"
+	loginpkg "github.com/adh-partnership/sso/pkg/login"
+	"github.com/adh-partnership/sso/pkg/tokens"
+	"github.com/gin-gonic/gin"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwe"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+const (
+	testClientID     = "e2e-client"
+	testClientSecret = "e2e-secret"
+	testRedirectURI  = "https://app.example.com/callback"
+	testUserAgent    = "e2e-test"
+
+	// The token endpoint under the default SSO_ISSUERKEY
+	testTokenEndpoint = "https://auth.denartcc.org/oauth/token"
+)
+
+var testUser = idp.User{
+	CID:         1234567,
+	FirstName:   "Jane",
+	LastName:    "Controller",
+	Email:       "jane@example.com",
+	RatingID:    5,
+	RatingShort: "C1",
+	RatingLong:  "Controller",
+}
+
+type flow struct {
+	t        *testing.T
+	server   *Server
+	upstream *idptest.Server
+	noFollow *http.Client
+}
+
+func setupFlow(t *testing.T) *flow {
+	gin.SetMode(gin.TestMode)
+
+	modelstest.Setup(t)
+	seed.CheckSeeds()
+
+	client := dbTypes.OAuthClient{
+		ID:           1,
+		Name:         "e2e",
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURIs: fmt.Sprintf(`["%s"]`, testRedirectURI),
+		TTL:          3600,
+	}
+	if err := models.DB.Create(&client).Error; err != nil {
+		t.Fatalf("creating client: %s", err)
+	}
+
+	role := dbTypes.Role{Name: "wm"}
+	user := dbTypes.User{
+		CID:       testUser.CID,
+		FirstName: testUser.FirstName,
+		LastName:  testUser.LastName,
+		Email:     testUser.Email,
+		RatingID:  testUser.RatingID,
+		Roles:     []*dbTypes.Role{&role},
+	}
+	if err := models.DB.Create(&user).Error; err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+
+	if err := tokens.BuildKeyset(testKeyset(t)); err != nil {
+		t.Fatalf("building keyset: %s", err)
+	}
+
+	upstream := idptest.NewServer(testUser)
+	t.Cleanup(upstream.Close)
+	idp.Current = idp.NewVatsim(upstream.Config())
+
+	f := &flow{
+		t:        t,
+		server:   NewServer("test"),
+		upstream: upstream,
+		noFollow: &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	if err := f.configure(models.OAuthClientSettings{}); err != nil {
+		t.Fatalf("creating client settings: %s", err)
+	}
+	return f
+}
+
+// configure replaces the test client's settings. Without grant types or
+// scopes of its own the client may use every one.
+func (f *flow) configure(settings models.OAuthClientSettings) error {
+	settings.ClientID = 1
+	if settings.GrantTypes == nil {
+		settings.GrantTypes = models.GrantTypes
+	}
+	if settings.AllowedScopes == nil {
+		settings.AllowedScopes = datatypes.JSONMap{models.AllScopes}
+	}
+	if err := models.DB.Where("client_id = ?", settings.ClientID).Delete(&models.OAuthClientSettings{}).Error; err != nil {
+		return err
+	}
+	return models.DB.Create(&settings).Error
+}
+
+func testKeyset(t *testing.T) string {
+	raw, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	key, err := jwk.FromRaw(raw)
+	if err != nil {
+		t.Fatalf("building jwk: %s", err)
+	}
+	key.Set(jwk.KeyIDKey, "e2e")
+	key.Set(jwk.AlgorithmKey, jwa.RS256)
+
+	set := jwk.NewSet()
+	set.AddKey(key)
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("marshalling keyset: %s", err)
+	}
+	return string(data)
+}
+
+// testClientKey generates a key pair for the client, returning the private key
+// and the public JWKS to register.
+func testClientKey(t *testing.T, use jwk.KeyUsageType) (jwk.Key, string) {
+	raw, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating client key: %s", err)
+	}
+	private, _ := jwk.FromRaw(raw)
+	private.Set(jwk.KeyIDKey, "client-"+string(use))
+	private.Set(jwk.KeyUsageKey, use)
+	public, _ := private.PublicKey()
+
+	set := jwk.NewSet()
+	set.AddKey(public)
+	jwks, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("marshalling client keyset: %s", err)
+	}
+	return private, string(jwks)
+}
+
+func (f *flow) serve(req *http.Request) *httptest.ResponseRecorder {
+	req.Header.Set("User-Agent", testUserAgent)
+	w := httptest.NewRecorder()
+	f.server.engine.ServeHTTP(w, req)
+	return w
+}
+
+// authorize runs GetAuthorize, the upstream login and GetCallback and returns
+// the query the client receives on its redirect uri.
+func (f *flow) authorize(params url.Values) url.Values {
+	t := f.t
+
+	w := f.serve(httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+params.Encode(), nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("authorize: expected %d, got %d: %s", http.StatusTemporaryRedirect, w.Code, w.Body.String())
+	}
+	cookies := w.Result().Cookies()
+
+	resp, err := f.noFollow.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("upstream authorize: %s", err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || callback.Path != "/oauth/callback" {
+		t.Fatalf("upstream authorize: unexpected redirect %q", resp.Header.Get("Location"))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w = f.serve(req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("callback: expected %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+	}
+
+	ret, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(ret.String(), testRedirectURI) {
+		t.Fatalf("callback: unexpected redirect %q", w.Header().Get("Location"))
+	}
+	return ret.Query()
+}
+
+func (f *flow) token(form url.Values) (int, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(testClientID, testClientSecret)
+	w := f.serve(req)
+
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		f.t.Fatalf("token: invalid response %q: %s", w.Body.String(), err)
+	}
+	return w.Code, body
+}
+
+// login runs the authorization code flow with PKCE as testUser and returns
+// the token response.
+func (f *flow) login() map[string]interface{} {
+	return f.loginWithScope("openid profile email")
+}
+
+// loginWithScope is login asking for scope instead.
+func (f *flow) loginWithScope(scope string) map[string]interface{} {
+	t := f.t
+
+	verifier, challenge := pkcePair()
+	params := authorizeParams(challenge)
+	params.Set("scope", scope)
+	ret := f.authorize(params)
+	status, body := f.token(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {ret.Get("code")},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("token: expected %d, got %d: %+v", http.StatusOK, status, body)
+	}
+	return body
+}
+
+func pkcePair() (string, string) {
+	verifier := base64.RawURLEncoding.EncodeToString([]byte("an e2e code verifier that is long enough"))
+	hash := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func authorizeParams(challenge string) url.Values {
+	return url.Values{
+		"client_id":             {testClientID},
+		"redirect_uri":          {testRedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"openid profile email"},
+		"state":                 {"e2e-state"},
+		"nonce":                 {"e2e-nonce"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+func parseToken(t *testing.T, body map[string]interface{}, field string) jwt.Token {
+	raw, _ := body[field].(string)
+	if raw == "" {
+		t.Fatalf("no %s in token response: %+v", field, body)
+	}
+	token, err := tokens.ParseToken([]byte(raw))
+	if err != nil {
+		t.Fatalf("%s does not verify: %s", field, err)
+	}
+	return token
+}
+
+func claim(token jwt.Token, name string) interface{} {
+	v, _ := token.Get(name)
+	return v
+}
+
+func TestAuthorizationCodeFlowWithPKCE(t *testing.T) {
+	f := setupFlow(t)
+	verifier, challenge := pkcePair()
+
+	ret := f.authorize(authorizeParams(challenge))
+	if ret.Get("state") != "e2e-state" {
+		t.Errorf("expected state to be returned, got %q", ret.Get("state"))
+	}
+	if ret.Get("code") == "" {
+		t.Fatalf("no code returned: %v", ret)
+	}
+
+	status, body := f.token(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {ret.Get("code")},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("token: expected %d, got %d: %+v", http.StatusOK, status, body)
+	}
+
+	access := parseToken(t, body, "access_token")
+	if access.Subject() != fmt.Sprint(testUser.CID) {
+		t.Errorf("access token sub: expected %d, got %s", testUser.CID, access.Subject())
+	}
+	if claim(access, "client_id") != testClientID {
+		t.Errorf("access token client_id: expected %s, got %v", testClientID, claim(access, "client_id"))
+	}
+	if claim(access, "scope") != "openid profile email" {
+		t.Errorf("access token scope: got %v", claim(access, "scope"))
+	}
+	if roles, _ := claim(access, "roles").([]interface{}); len(roles) != 1 || roles[0] != "wm" {
+		t.Errorf("access token roles: got %v", claim(access, "roles"))
+	}
+
+	id := parseToken(t, body, "id_token")
+	if id.Subject() != fmt.Sprint(testUser.CID) {
+		t.Errorf("id token sub: expected %d, got %s", testUser.CID, id.Subject())
+	}
+	if len(id.Audience()) != 1 || id.Audience()[0] != "e2e" {
+		t.Errorf("id token aud: got %v", id.Audience())
+	}
+	for name, expected := range map[string]string{
+		"name":        "Jane Controller",
+		"given_name":  testUser.FirstName,
+		"family_name": testUser.LastName,
+		"email":       testUser.Email,
+		"nonce":       "e2e-nonce",
+	} {
+		if claim(id, name) != expected {
+			t.Errorf("id token %s: expected %q, got %v", name, expected, claim(id, name))
+		}
+	}
+
+	if body["refresh_token"] == "" || body["refresh_token"] == nil {
+		t.Errorf("no refresh token issued: %+v", body)
+	}
+}
+
+func TestAuthorizationCodeRejectsBadVerifier(t *testing.T) {
+	f := setupFlow(t)
+	_, challenge := pkcePair()
+
+	ret := f.authorize(authorizeParams(challenge))
+
+	status, body := f.token(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {ret.Get("code")},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {"not-the-verifier"},
+	})
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("expected invalid_grant, got %d: %+v", status, body)
+	}
+}
+
+func TestAuthorizationCodeIsSingleUse(t *testing.T) {
+	f := setupFlow(t)
+	verifier, challenge := pkcePair()
+
+	ret := f.authorize(authorizeParams(challenge))
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {ret.Get("code")},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	}
+
+	if status, body := f.token(form); status != http.StatusOK {
+		t.Fatalf("first exchange: expected %d, got %d: %+v", http.StatusOK, status, body)
+	}
+	if status, body := f.token(form); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("second exchange: expected invalid_grant, got %d: %+v", status, body)
+	}
+}
+
+func TestRefreshTokenRotationAndReuse(t *testing.T) {
+	f := setupFlow(t)
+	first := f.login()["refresh_token"].(string)
+
+	status, body := f.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first}})
+	if status != http.StatusOK {
+		t.Fatalf("refresh: expected %d, got %d: %+v", http.StatusOK, status, body)
+	}
+	if body["scope"] != "openid profile email" {
+		t.Errorf("refresh: expected the original scopes, got %v", body["scope"])
+	}
+	parseToken(t, body, "id_token")
+	second := body["refresh_token"].(string)
+
+	// Replaying the rotated token revokes the whole family
+	if status, body = f.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first}}); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("replay: expected invalid_grant, got %d: %+v", status, body)
+	}
+	if status, body = f.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {second}}); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("after replay: expected invalid_grant, got %d: %+v", status, body)
+	}
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	tests := []struct {
+		name      string
+		settings  models.OAuthClientSettings
+		scope     string
+		wantError string
+	}{
+		{name: "token for the client"},
+		{name: "scope for a user", scope: "email", wantError: "invalid_scope"},
+		{
+			name:      "public client",
+			settings:  models.OAuthClientSettings{ClientType: models.ClientTypePublic, GrantTypes: models.DefaultGrantTypes},
+			wantError: "unauthorized_client",
+		},
+		{
+			name:      "client without the grant",
+			settings:  models.OAuthClientSettings{GrantTypes: datatypes.JSONMap{}},
+			wantError: "unauthorized_client",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := setupFlow(t)
+			if err := f.configure(tt.settings); err != nil {
+				t.Fatalf("creating client settings: %s", err)
+			}
+
+			// A public client only identifies itself
+			public := tt.settings.ClientType == models.ClientTypePublic
+			form := url.Values{"grant_type": {"client_credentials"}, "scope": {tt.scope}}
+			if public {
+				form.Set("client_id", testClientID)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if !public {
+				req.SetBasicAuth(testClientID, testClientSecret)
+			}
+			w := f.serve(req)
+
+			body := map[string]interface{}{}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if tt.wantError != "" {
+				if w.Code != http.StatusBadRequest || body["error"] != tt.wantError {
+					t.Fatalf("expected %s, got %d: %+v", tt.wantError, w.Code, body)
+				}
+				return
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected %d, got %d: %+v", http.StatusOK, w.Code, body)
+			}
+
+			access := parseToken(t, body, "access_token")
+			if access.Subject() != testClientID || claim(access, "client_id") != testClientID {
+				t.Errorf("expected the client to be the subject, got %s for %v", access.Subject(), claim(access, "client_id"))
+			}
+			if body["refresh_token"] != nil || body["id_token"] != nil {
+				t.Errorf("expected only an access token, got %+v", body)
+			}
+		})
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	f := setupFlow(t)
+
+	body := f.login()
+	_, client := f.token(url.Values{"grant_type": {"client_credentials"}})
+	revoked := f.login()["access_token"].(string)
+	if status, _ := f.post("/oauth/revoke", url.Values{"token": {revoked}}); status != http.StatusOK {
+		t.Fatalf("revoke: expected %d, got %d", http.StatusOK, status)
+	}
+	expired, err := tokens.CreateAccessToken(tokens.DefaultAlgorithm, "auth.denartcc.org", "e2e", fmt.Sprint(testUser.CID), -60, map[string]interface{}{
+		"client_id": testClientID,
+		"scope":     "openid",
+	})
+	if err != nil {
+		t.Fatalf("creating access token: %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		wantType  string // Empty expects the token to be inactive
+		wantSub   string
+		wantRoles bool
+	}{
+		{name: "access token", token: body["access_token"].(string), wantType: "access_token", wantSub: fmt.Sprint(testUser.CID), wantRoles: true},
+		{name: "refresh token", token: body["refresh_token"].(string), wantType: "refresh_token", wantSub: fmt.Sprint(testUser.CID), wantRoles: true},
+		{name: "client credentials token", token: client["access_token"].(string), wantType: "access_token", wantSub: testClientID},
+		{name: "expired token", token: string(expired)},
+		{name: "revoked token", token: revoked},
+		{name: "unknown token", token: "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, got := f.post("/oauth/introspect", url.Values{"token": {tt.token}})
+			if status != http.StatusOK {
+				t.Fatalf("expected %d, got %d: %+v", http.StatusOK, status, got)
+			}
+			if tt.wantType == "" {
+				if len(got) != 1 || got["active"] != false {
+					t.Errorf("expected only active: false, got %+v", got)
+				}
+				return
+			}
+			if got["active"] != true || got["token_type"] != tt.wantType || got["sub"] != tt.wantSub || got["client_id"] != testClientID {
+				t.Errorf("expected an active %s for %s, got %+v", tt.wantType, tt.wantSub, got)
+			}
+			if (got["roles"] != nil) != tt.wantRoles {
+				t.Errorf("expected roles %v, got %+v", tt.wantRoles, got["roles"])
+			}
+		})
+	}
+
+	// Only an authenticated client may introspect
+	for name, auth := range map[string]func(*http.Request){
+		"no credentials": func(*http.Request) {},
+		"wrong secret":   func(req *http.Request) { req.SetBasicAuth(testClientID, "wrong") },
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/introspect", strings.NewReader(url.Values{"token": {body["access_token"].(string)}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		auth(req)
+		if w := f.serve(req); w.Code != http.StatusUnauthorized || strings.Contains(w.Body.String(), "active") {
+			t.Errorf("introspect with %s: expected %d, got %d: %s", name, http.StatusUnauthorized, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	f := setupFlow(t)
+
+	other := dbTypes.OAuthClient{ID: 2, Name: "other", ClientID: "other-client", ClientSecret: "other-secret", RedirectURIs: "[]", TTL: 3600}
+	if err := models.DB.Create(&other).Error; err != nil {
+		t.Fatalf("creating client: %s", err)
+	}
+	revokeAs := func(client *dbTypes.OAuthClient, secret, token string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/revoke", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ClientID, secret)
+		w := f.serve(req)
+
+		body := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+	active := func(token string) bool {
+		_, body := f.post("/oauth/introspect", url.Values{"token": {token}})
+		return body["active"] == true
+	}
+
+	body := f.login()
+	access, refresh := body["access_token"].(string), body["refresh_token"].(string)
+
+	for name, token := range map[string]string{"access token": access, "refresh token": refresh} {
+		if status, body := revokeAs(&other, "other-secret", token); status != http.StatusBadRequest || body["error"] != "unauthorized_client" {
+			t.Errorf("revoking another client's %s: expected unauthorized_client, got %d: %+v", name, status, body)
+		}
+		if !active(token) {
+			t.Errorf("expected another client's attempt to leave the %s active", name)
+		}
+	}
+
+	// RFC7009 2.2, the client can't tell a token it doesn't know from one already revoked
+	if status, _ := f.post("/oauth/revoke", url.Values{"token": {"unknown"}}); status != http.StatusOK {
+		t.Errorf("revoking an unknown token: expected %d, got %d", http.StatusOK, status)
+	}
+
+	if status, _ := f.post("/oauth/revoke", url.Values{"token": {access}}); status != http.StatusOK {
+		t.Fatalf("revoking the access token: expected %d, got %d", http.StatusOK, status)
+	}
+	if active(access) || !active(refresh) {
+		t.Errorf("expected only the access token to be revoked")
+	}
+
+	// Revoking any refresh token ends the family, reference tokens issued with it included
+	if err := f.configure(models.OAuthClientSettings{AccessTokenFormat: models.AccessTokenFormatReference}); err != nil {
+		t.Fatalf("creating client settings: %s", err)
+	}
+	status, rotated := f.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh}})
+	if status != http.StatusOK {
+		t.Fatalf("refresh: expected %d, got %d: %+v", http.StatusOK, status, rotated)
+	}
+	rotatedAccess, rotatedRefresh := rotated["access_token"].(string), rotated["refresh_token"].(string)
+	if status, _ := f.post("/oauth/revoke", url.Values{"token": {rotatedRefresh}, "token_type_hint": {"refresh_token"}}); status != http.StatusOK {
+		t.Fatalf("revoking the refresh token: expected %d, got %d", http.StatusOK, status)
+	}
+	if active(rotatedRefresh) || active(rotatedAccess) {
+		t.Errorf("expected the refresh token and the access token issued with it to be revoked")
+	}
+	family := models.OAuthRefreshFamily{}
+	if err := models.DB.Where("family_id = ?", loginpkg.FamilyOf(rotatedRefresh)).First(&family).Error; err != nil || family.RevokedAt == nil {
+		t.Errorf("expected the family to be revoked, got %+v: %v", family, err)
+	}
+	if status, body := f.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {rotatedRefresh}}); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("refresh after revoke: expected invalid_grant, got %d: %+v", status, body)
+	}
+}
+
+func TestUserInfoScopes(t *testing.T) {
+	tests := []struct {
+		scope string
+		want  []string
+	}{
+		{scope: "openid", want: []string{"sub"}},
+		{scope: "openid email", want: []string{"email", "sub"}},
+		{scope: "openid profile rating roles", want: []string{"family_name", "given_name", "name", "rating", "roles", "sub"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			f := setupFlow(t)
+			body := f.loginWithScope(tt.scope)
+
+			req := httptest.NewRequest(http.MethodGet, "/oauth/userinfo", nil)
+			req.Header.Set("Authorization", "Bearer "+body["access_token"].(string))
+			w := f.serve(req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			got := map[string]interface{}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding userinfo: %s", err)
+			}
+			names := []string{}
+			for name := range got {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+				t.Errorf("expected %v, got %+v", tt.want, got)
+			}
+			if got["sub"] != fmt.Sprint(testUser.CID) {
+				t.Errorf("expected sub %d, got %v", testUser.CID, got["sub"])
+			}
+		})
+	}
+}
+
+func TestCertsAreCacheable(t *testing.T) {
+	f := setupFlow(t)
+
+	w := f.serve(httptest.NewRequest(http.MethodGet, "/oauth/certs", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, w.Code)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Cache-Control") == "" {
+		t.Fatalf("expected caching headers, got %+v", w.Header())
+	}
+
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding JWKS: %s", err)
+	}
+	if len(body) != 1 || body["keys"] == nil {
+		t.Errorf("expected a bare JWK Set, got %+v", body)
+	}
+	for _, k := range body["keys"].([]interface{}) {
+		if _, ok := k.(map[string]interface{})["d"]; ok {
+			t.Errorf("private key material published: %+v", k)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/oauth/certs", nil)
+	req.Header.Set("If-None-Match", etag)
+	if w = f.serve(req); w.Code != http.StatusNotModified {
+		t.Fatalf("expected %d, got %d", http.StatusNotModified, w.Code)
+	}
+}
+
+func TestEncryptedIDToken(t *testing.T) {
+	f := setupFlow(t)
+
+	private, jwks := testClientKey(t, jwk.ForEncryption)
+	if err := f.configure(models.OAuthClientSettings{
+		IDTokenEncryptedResponseAlg: "RSA-OAEP-256",
+		JWKS:                        jwks,
+	}); err != nil {
+		t.Fatalf("creating client settings: %s", err)
+	}
+
+	body := f.login()
+
+	encrypted, _ := body["id_token"].(string)
+	if strings.Count(encrypted, ".") != 4 {
+		t.Fatalf("expected a compact JWE id token, got %q", encrypted)
+	}
+	signed, err := jwe.Decrypt([]byte(encrypted), jwe.WithKey(jwa.RSA_OAEP_256, private))
+	if err != nil {
+		t.Fatalf("decrypting id token: %s", err)
+	}
+	id, err := tokens.ParseToken(signed)
+	if err != nil {
+		t.Fatalf("nested id token does not verify: %s", err)
+	}
+	if id.Subject() != fmt.Sprint(testUser.CID) {
+		t.Errorf("id token sub: expected %d, got %s", testUser.CID, id.Subject())
+	}
+}
+
+func TestClaimMappings(t *testing.T) {
+	f := setupFlow(t)
+
+	if err := f.configure(models.OAuthClientSettings{
+		ClaimMappings: claims.Mappings{{Claim: "sub", Source: "email"}},
+	}); !errors.Is(err, claims.ErrInvalidClaim) {
+		t.Fatalf("expected mapping a reserved claim to be rejected, got %v", err)
+	}
+
+	if err := f.configure(models.OAuthClientSettings{
+		ClaimMappings: claims.Mappings{
+			{Claim: "groups", Source: "roles", Targets: []string{claims.TargetIDToken}},
+			{Claim: "cid", Source: "cid", Type: claims.TypeString, Targets: []string{claims.TargetAccessToken}},
+		},
+	}); err != nil {
+		t.Fatalf("creating client settings: %s", err)
+	}
+
+	body := f.login()
+
+	id := parseToken(t, body, "id_token")
+	if groups, _ := claim(id, "groups").([]interface{}); len(groups) != 1 || groups[0] != "wm" {
+		t.Errorf("id token groups: got %v", claim(id, "groups"))
+	}
+	if claim(id, "cid") != nil {
+		t.Errorf("id token: cid is only mapped into access tokens, got %v", claim(id, "cid"))
+	}
+
+	access := parseToken(t, body, "access_token")
+	if claim(access, "cid") != fmt.Sprint(testUser.CID) {
+		t.Errorf("access token cid: expected %q, got %v", fmt.Sprint(testUser.CID), claim(access, "cid"))
+	}
+}
+
+func (f *flow) post(path string, form url.Values) (int, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(testClientID, testClientSecret)
+	w := f.serve(req)
+
+	body := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body
+}
+
+func TestReferenceAccessTokens(t *testing.T) {
+	f := setupFlow(t)
+
+	if err := f.configure(models.OAuthClientSettings{
+		AccessTokenFormat: models.AccessTokenFormatReference,
+	}); err != nil {
+		t.Fatalf("creating client settings: %s", err)
+	}
+
+	body := f.login()
+	access, _ := body["access_token"].(string)
+	if strings.Contains(access, ".") {
+		t.Fatalf("expected an opaque access token, got %q", access)
+	}
+
+	_, body = f.post("/oauth/introspect", url.Values{"token": {access}})
+	if body["active"] != true || body["sub"] != fmt.Sprint(testUser.CID) || body["client_id"] != testClientID {
+		t.Fatalf("introspect: expected the token to be active, got %+v", body)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/oauth/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+access)
+	if w := f.serve(req); w.Code != http.StatusOK {
+		t.Fatalf("userinfo: expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if status, body := f.post("/oauth/revoke", url.Values{"token": {access}}); status != http.StatusOK {
+		t.Fatalf("revoke: expected %d, got %d: %+v", http.StatusOK, status, body)
+	}
+	if _, body = f.post("/oauth/introspect", url.Values{"token": {access}}); body["active"] != false {
+		t.Fatalf("introspect after revoke: expected the token to be inactive, got %+v", body)
+	}
+}
+
+func TestLogoutDeletesReferenceTokens(t *testing.T) {
+	f := setupFlow(t)
+
+	if err := f.configure(models.OAuthClientSettings{
+		AccessTokenFormat: models.AccessTokenFormatReference,
+	}); err != nil {
+		t.Fatalf("creating client settings: %s", err)
+	}
+
+	body := f.login()
+	access, _ := body["access_token"].(string)
+	refresh, _ := body["refresh_token"].(string)
+	idToken, _ := body["id_token"].(string)
+
+	// The access token isn't an id_token_hint, nor is an unregistered uri allowed
+	for _, params := range []url.Values{
+		{"id_token_hint": {access}},
+		{"id_token_hint": {idToken}, "post_logout_redirect_uri": {"https://evil.example.com"}},
+	} {
+		if w := f.serve(httptest.NewRequest(http.MethodGet, "/oauth/logout?"+params.Encode(), nil)); w.Code == http.StatusFound || w.Code == http.StatusOK {
+			t.Fatalf("logout with %v: expected an error, got %d", params, w.Code)
+		}
+	}
+	if _, body = f.post("/oauth/introspect", url.Values{"token": {access}}); body["active"] != true {
+		t.Fatalf("introspect: expected a rejected logout to keep the token, got %+v", body)
+	}
+
+	// The hint is addressed to a name, another client with it makes the hint
+	// alone ambiguous and the hint isn't addressed to a client with another name
+	twin := dbTypes.OAuthClient{ID: 2, Name: "e2e", ClientID: "twin-client", ClientSecret: "twin-secret", RedirectURIs: `["` + testRedirectURI + `"]`, TTL: 3600}
+	other := dbTypes.OAuthClient{ID: 3, Name: "other", ClientID: "other-client", ClientSecret: "other-secret", RedirectURIs: `["` + testRedirectURI + `"]`, TTL: 3600}
+	for _, client := range []*dbTypes.OAuthClient{&twin, &other} {
+		if err := models.DB.Create(client).Error; err != nil {
+			t.Fatalf("creating client: %s", err)
+		}
+	}
+	for _, params := range []url.Values{
+		{"id_token_hint": {idToken}},
+		{"id_token_hint": {idToken}, "client_id": {"other-client"}},
+	} {
+		if w := f.serve(httptest.NewRequest(http.MethodGet, "/oauth/logout?"+params.Encode(), nil)); w.Code == http.StatusFound || w.Code == http.StatusOK {
+			t.Fatalf("logout with %v: expected an error, got %d", params, w.Code)
+		}
+	}
+
+	w := f.serve(httptest.NewRequest(http.MethodGet, "/oauth/logout?"+url.Values{
+		"id_token_hint":            {idToken},
+		"client_id":                {testClientID},
+		"post_logout_redirect_uri": {testRedirectURI},
+		"state":                    {"logout-state"},
+	}.Encode(), nil))
+	if w.Code != http.StatusFound || !strings.Contains(w.Header().Get("Location"), "state=logout-state") {
+		t.Fatalf("logout: expected a redirect with the state, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	if _, body = f.post("/oauth/introspect", url.Values{"token": {access}}); body["active"] != false {
+		t.Fatalf("introspect after logout: expected the token to be deleted, got %+v", body)
+	}
+	if status, body := f.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh}}); status == http.StatusOK {
+		t.Fatalf("refresh after logout: expected an error, got %+v", body)
+	}
+}
+
+func TestSignedRequestObject(t *testing.T) {
+	f := setupFlow(t)
+
+	// Serves the request objects request_uri points at
+	published := map[string]string{}
+	objects := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(published[r.URL.Path]))
+	}))
+	t.Cleanup(objects.Close)
+	transport := loginpkg.RequestURIClient.Transport
+	loginpkg.RequestURIClient.Transport = objects.Client().Transport
+	t.Cleanup(func() { loginpkg.RequestURIClient.Transport = transport })
+
+	private, jwks := testClientKey(t, jwk.ForSignature)
+	if err := f.configure(models.OAuthClientSettings{
+		JWKS:        jwks,
+		RequestURIs: []string{objects.URL + "/objects/"},
+	}); err != nil {
+		t.Fatalf("creating client settings: %s", err)
+	}
+
+	_, challenge := pkcePair()
+	build := func(change func(jwt.Token)) jwt.Token {
+		object := jwt.New()
+		for name, values := range authorizeParams(challenge) {
+			object.Set(name, values[0])
+		}
+		object.Set("state", "from-the-object")
+		object.Set(jwt.IssuerKey, testClientID)
+		object.Set(jwt.AudienceKey, "https://auth.denartcc.org")
+		object.Set(jwt.ExpirationKey, time.Now().Add(time.Minute))
+		if change != nil {
+			change(object)
+		}
+		return object
+	}
+	sign := func(change func(jwt.Token)) string {
+		signed, err := jwt.Sign(build(change), jwt.WithKey(jwa.RS256, private))
+		if err != nil {
+			t.Fatalf("signing request object: %s", err)
+		}
+		return string(signed)
+	}
+
+	// Parameters outside the object are ignored
+	ret := f.authorize(url.Values{
+		"client_id": {testClientID},
+		"request":   {sign(nil)},
+		"state":     {"from-the-query"},
+	})
+	if ret.Get("state") != "from-the-object" || ret.Get("code") == "" {
+		t.Fatalf("expected a code and the state from the object, got %v", ret)
+	}
+
+	published["/objects/1"] = sign(nil)
+	ret = f.authorize(url.Values{
+		"client_id":   {testClientID},
+		"request_uri": {objects.URL + "/objects/1"},
+	})
+	if ret.Get("state") != "from-the-object" || ret.Get("code") == "" {
+		t.Fatalf("request_uri: expected a code and the state from the object, got %v", ret)
+	}
+
+	payload, _ := json.Marshal(build(nil))
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+	published["/objects/other-client"] = sign(func(o jwt.Token) { o.Set("client_id", "other-client") })
+
+	tests := []struct {
+		name   string
+		params url.Values
+	}{
+		{name: "unsigned", params: url.Values{"request": {unsigned}}},
+		{name: "another client_id", params: url.Values{"request": {sign(func(o jwt.Token) { o.Set("client_id", "other-client") })}}},
+		{name: "another iss", params: url.Values{"request": {sign(func(o jwt.Token) { o.Set(jwt.IssuerKey, "other-client") })}}},
+		{name: "no aud", params: url.Values{"request": {sign(func(o jwt.Token) { o.Remove(jwt.AudienceKey) })}}},
+		{name: "another aud", params: url.Values{"request": {sign(func(o jwt.Token) { o.Set(jwt.AudienceKey, "https://other.example.com") })}}},
+		{name: "aud of the request host", params: url.Values{"request": {sign(func(o jwt.Token) { o.Set(jwt.AudienceKey, "https://example.com") })}}},
+		{name: "no exp", params: url.Values{"request": {sign(func(o jwt.Token) { o.Remove(jwt.ExpirationKey) })}}},
+		{name: "exp too far away", params: url.Values{"request": {sign(func(o jwt.Token) { o.Set(jwt.ExpirationKey, time.Now().Add(time.Hour)) })}}},
+		{name: "request_uri with another client_id", params: url.Values{"request_uri": {objects.URL + "/objects/other-client"}}},
+		{name: "unregistered request_uri", params: url.Values{"request_uri": {objects.URL + "/elsewhere/1"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params.Set("client_id", testClientID)
+			w := f.serve(httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+tt.params.Encode(), nil))
+			if w.Code == http.StatusTemporaryRedirect || w.Code == http.StatusFound {
+				t.Fatalf("expected the request object to be rejected, got %d to %q", w.Code, w.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestPrivateKeyJWTClientAuthentication(t *testing.T) {
+	f := setupFlow(t)
+
+	private, jwks := testClientKey(t, jwk.ForSignature)
+	if err := f.configure(models.OAuthClientSettings{
+		JWKS:                    jwks,
+		TokenEndpointAuthMethod: models.AuthMethodPrivateKeyJWT,
+	}); err != nil {
+		t.Fatalf("creating client settings: %s", err)
+	}
+
+	sign := func(aud, jti string) []byte {
+		assertion := jwt.New()
+		assertion.Set(jwt.IssuerKey, testClientID)
+		assertion.Set(jwt.SubjectKey, testClientID)
+		assertion.Set(jwt.AudienceKey, aud)
+		assertion.Set(jwt.JwtIDKey, jti)
+		assertion.Set(jwt.ExpirationKey, time.Now().Add(time.Minute))
+		signed, err := jwt.Sign(assertion, jwt.WithKey(jwa.RS256, private))
+		if err != nil {
+			t.Fatalf("signing client assertion: %s", err)
+		}
+		return signed
+	}
+	signed := sign(testTokenEndpoint, "e2e-assertion")
+
+	send := func(signed []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(url.Values{
+			"grant_type":            {"client_credentials"},
+			"client_assertion_type": {loginpkg.ClientAssertionTypeJWTBearer},
+			"client_assertion":      {string(signed)},
+		}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return f.serve(req)
+	}
+
+	// The Host header doesn't decide which audiences are accepted
+	if w := send(sign("https://example.com/oauth/token", "e2e-host-assertion")); w.Code != http.StatusUnauthorized {
+		t.Fatalf("assertion for the request host: expected %d, got %d: %s", http.StatusUnauthorized, w.Code, w.Body.String())
+	}
+	if w := send(signed); w.Code != http.StatusOK {
+		t.Fatalf("token: expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := send(signed); w.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed assertion: expected %d, got %d: %s", http.StatusUnauthorized, w.Code, w.Body.String())
+	}
+
+	// Failing to record the jti is a server error, not a replay
+	if err := models.DB.Migrator().DropTable(&models.OAuthClientAssertion{}); err != nil {
+		t.Fatalf("dropping assertion table: %s", err)
+	}
+	if w := send(signed); w.Code != http.StatusInternalServerError {
+		t.Fatalf("assertion without a database: expected %d, got %d: %s", http.StatusInternalServerError, w.Code, w.Body.String())
+	}
+
+	// The client is registered for private_key_jwt, its secret is not enough
+	status, body := f.token(url.Values{"grant_type": {"client_credentials"}})
+	if status != http.StatusUnauthorized || body["error"] != "invalid_client" {
+		t.Fatalf("client_secret_basic: expected invalid_client, got %d: %+v", status, body)
+	}
+}
+
+func TestAdminClients(t *testing.T) {
+	t.Setenv("SSO_ADMIN_CLIENT_IDS", "admin-ui,"+testClientID)
+	f := setupFlow(t)
+
+	body := f.login()
+	access, _ := body["access_token"].(string)
+	idToken, _ := body["id_token"].(string)
+
+	adminWith := func(token, method, path string, payload interface{}) (int, map[string]interface{}) {
+		data, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, strings.NewReader(string(data)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := f.serve(req)
+
+		body := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+	admin := func(method, path string, payload interface{}) (int, map[string]interface{}) {
+		return adminWith(access, method, path, payload)
+	}
+
+	// The same admin's token from a client that isn't an admin client
+	other, err := tokens.CreateAccessToken(tokens.DefaultAlgorithm, "auth.denartcc.org", "other", fmt.Sprint(testUser.CID), 60, map[string]interface{}{
+		"client_id": "other-client",
+		"scope":     "openid",
+	})
+	if err != nil {
+		t.Fatalf("creating access token: %s", err)
+	}
+	for name, token := range map[string]string{"an id token": idToken, "another client's token": string(other)} {
+		if status, _ := adminWith(token, http.MethodGet, "/v1/admin/clients", nil); status != http.StatusForbidden {
+			t.Errorf("list with %s: expected %d, got %d", name, http.StatusForbidden, status)
+		}
+	}
+
+	if status, _ := admin(http.MethodPost, "/v1/admin/clients", map[string]interface{}{
+		"name":          "bad",
+		"redirect_uris": []string{"http://app.example.com/*"},
+	}); status != http.StatusBadRequest {
+		t.Fatalf("create with a wildcard redirect uri: expected %d, got %d", http.StatusBadRequest, status)
+	}
+
+	status, created := admin(http.MethodPost, "/v1/admin/clients", map[string]interface{}{
+		"name":          "admin-created",
+		"redirect_uris": []string{"https://admin.example.com/callback"},
+	})
+	if status != http.StatusCreated || created["client_secret"] == nil || created["client_id"] == nil {
+		t.Fatalf("create: expected a client with credentials, got %d: %+v", status, created)
+	}
+	path := fmt.Sprintf("/v1/admin/clients/%v", created["id"])
+
+	if _, got := admin(http.MethodGet, path, nil); got["client_secret"] != nil || got["name"] != "admin-created" {
+		t.Fatalf("get: expected the client without its secret, got %+v", got)
+	}
+	if settings, _ := created["settings"].(map[string]interface{}); fmt.Sprint(settings["allowed_scopes"]) != "[openid]" {
+		t.Errorf("create: expected a client without allowed scopes to only get openid, got %+v", created["settings"])
+	}
+	update := map[string]interface{}{
+		"name":          "admin-created",
+		"redirect_uris": []string{"https://admin.example.com/callback"},
+		"settings":      map[string]interface{}{"allowed_scopes": []string{}},
+	}
+	if status, _ := admin(http.MethodPut, path, update); status != http.StatusBadRequest {
+		t.Errorf("update without allowed scopes: expected %d, got %d", http.StatusBadRequest, status)
+	}
+	update["settings"] = map[string]interface{}{"allowed_scopes": []string{models.AllScopes}}
+	if status, body := admin(http.MethodPut, path, update); status != http.StatusOK {
+		t.Errorf("update allowing every scope: expected %d, got %d: %+v", http.StatusOK, status, body)
+	}
+
+	status, regenerated := admin(http.MethodPost, path+"/secret", nil)
+	if status != http.StatusOK || regenerated["client_secret"] == nil || regenerated["client_secret"] == created["client_secret"] {
+		t.Fatalf("regenerate secret: expected a new secret, got %d: %+v", status, regenerated)
+	}
+
+	if status, _ := admin(http.MethodDelete, path, nil); status != http.StatusNoContent {
+		t.Fatalf("delete: expected %d, got %d", http.StatusNoContent, status)
+	}
+	if status, _ := admin(http.MethodGet, path, nil); status != http.StatusNotFound {
+		t.Fatalf("get after delete: expected %d, got %d", http.StatusNotFound, status)
+	}
+
+	var audits []models.OAuthClientAudit
+	models.DB.Where(&models.OAuthClientAudit{CID: testUser.CID}).Order("id").Find(&audits)
+	if len(audits) != 4 || audits[0].Action != "create" || audits[3].Action != "delete" {
+		t.Fatalf("expected create, update, regenerate_secret and delete to be audited, got %+v", audits)
+	}
+}
+
+func TestDynamicClientRegistration(t *testing.T) {
+	f := setupFlow(t)
+
+	initial, _, err := clients.IssueInitialAccessToken("e2e", time.Hour, testUser.CID)
+	if err != nil {
+		t.Fatalf("issuing initial access token: %s", err)
+	}
+
+	send := func(method, path, token string, payload interface{}) (int, map[string]interface{}) {
+		data, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, strings.NewReader(string(data)))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := f.serve(req)
+
+		body := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	metadata := map[string]interface{}{
+		"client_name":                "prototype",
+		"grant_types":                []string{"client_credentials"},
+		"token_endpoint_auth_method": "client_secret_post",
+	}
+	if status, _ := send(http.MethodPost, "/oauth/register", "", metadata); status != http.StatusUnauthorized {
+		t.Fatalf("register without an initial access token: expected %d, got %d", http.StatusUnauthorized, status)
+	}
+
+	// Anything we'd fetch from must be a full https URL outside our network
+	for _, fetched := range []map[string]interface{}{
+		{"request_uris": []string{"https://"}},
+		{"request_uris": []string{"http://app.example.com/requests/"}},
+		{"request_uris": []string{"https://10.0.0.1/requests/"}},
+		{"jwks_uri": "https://localhost/jwks.json"},
+		{"jwks_uri": "https://169.254.169.254/latest/meta-data"},
+	} {
+		for name, value := range metadata {
+			fetched[name] = value
+		}
+		if status, body := send(http.MethodPost, "/oauth/register", initial, fetched); status != http.StatusBadRequest || body["error"] != "invalid_client_metadata" {
+			t.Errorf("register with %v: expected invalid_client_metadata, got %d: %+v", fetched, status, body)
+		}
+	}
+
+	status, registered := send(http.MethodPost, "/oauth/register", initial, metadata)
+	if status != http.StatusCreated || registered["client_secret"] == nil || registered["registration_access_token"] == nil {
+		t.Fatalf("register: expected a client with credentials, got %d: %+v", status, registered)
+	}
+	clientID, _ := registered["client_id"].(string)
+	clientSecret, _ := registered["client_secret"].(string)
+	rat, _ := registered["registration_access_token"].(string)
+	path := "/oauth/register/" + clientID
+	if registered["scope"] != "openid" {
+		t.Errorf("register: expected a client without a scope to only get openid, got %v", registered["scope"])
+	}
+	audit := models.OAuthClientAudit{}
+	if err := models.DB.Where(&models.OAuthClientAudit{Action: clients.ActionCreate}).Last(&audit).Error; err != nil || audit.CID != testUser.CID {
+		t.Errorf("register: expected the creation to be audited as the issuer of the initial access token, got %+v", audit)
+	}
+
+	// Tokens are addressed to the client's name, it must be there and unique
+	for _, name := range []interface{}{nil, "", "prototype", "e2e"} {
+		named := map[string]interface{}{}
+		for key, value := range metadata {
+			named[key] = value
+		}
+		named["client_name"] = name
+		if status, body := send(http.MethodPost, "/oauth/register", initial, named); status != http.StatusBadRequest || body["error"] != "invalid_client_metadata" {
+			t.Errorf("register with client_name %v: expected invalid_client_metadata, got %d: %+v", name, status, body)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+	}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := f.serve(req); w.Code != http.StatusOK {
+		t.Fatalf("token: expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if status, _ := send(http.MethodGet, path, initial, nil); status != http.StatusUnauthorized {
+		t.Fatalf("read with the initial access token: expected %d, got %d", http.StatusUnauthorized, status)
+	}
+	metadata["client_name"] = "e2e"
+	if status, body := send(http.MethodPut, path, rat, metadata); status != http.StatusBadRequest || body["error"] != "invalid_client_metadata" {
+		t.Fatalf("update to another client's name: expected invalid_client_metadata, got %d: %+v", status, body)
+	}
+	metadata["client_name"] = "renamed"
+	if status, body := send(http.MethodPut, path, rat, metadata); status != http.StatusOK || body["client_name"] != "renamed" {
+		t.Fatalf("update: expected the new name, got %d: %+v", status, body)
+	}
+	if status, body := send(http.MethodGet, path, rat, nil); status != http.StatusOK || body["client_name"] != "renamed" || body["client_secret"] != nil {
+		t.Fatalf("read: expected the updated client without its secret, got %d: %+v", status, body)
+	}
+
+	// The hashed secret can't verify assertions, so the switch comes with a new one
+	metadata["token_endpoint_auth_method"] = models.AuthMethodClientSecretJWT
+	status, updated := send(http.MethodPut, path, rat, metadata)
+	hmacSecret, _ := updated["client_secret"].(string)
+	if status != http.StatusOK || hmacSecret == "" || hmacSecret == clientSecret {
+		t.Fatalf("switch to client_secret_jwt: expected a new secret, got %d: %+v", status, updated)
+	}
+	assertion := jwt.New()
+	assertion.Set(jwt.IssuerKey, clientID)
+	assertion.Set(jwt.SubjectKey, clientID)
+	assertion.Set(jwt.AudienceKey, testTokenEndpoint)
+	assertion.Set(jwt.JwtIDKey, "e2e-hmac-assertion")
+	assertion.Set(jwt.ExpirationKey, time.Now().Add(time.Minute))
+	signed, err := jwt.Sign(assertion, jwt.WithKey(jwa.HS256, []byte(hmacSecret)))
+	if err != nil {
+		t.Fatalf("signing client assertion: %s", err)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_assertion_type": {loginpkg.ClientAssertionTypeJWTBearer},
+		"client_assertion":      {string(signed)},
+	}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := f.serve(req); w.Code != http.StatusOK {
+		t.Fatalf("token with client_secret_jwt: expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if status, _ := send(http.MethodDelete, path, rat, nil); status != http.StatusNoContent {
+		t.Fatalf("delete: expected %d, got %d", http.StatusNoContent, status)
+	}
+	if status, _ := send(http.MethodGet, path, rat, nil); status != http.StatusUnauthorized {
+		t.Fatalf("read after delete: expected %d, got %d", http.StatusUnauthorized, status)
+	}
+}
+
+func TestClientSecretRotation(t *testing.T) {
+	f := setupFlow(t)
+
+	authenticate := func(secret string) int {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(url.Values{
+			"grant_type": {"client_credentials"},
+		}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(testClientID, secret)
+		return f.serve(req).Code
+	}
+
+	// The seeded secret is plaintext, like the ones from before hashing
+	if status := authenticate(testClientSecret); status != http.StatusOK {
+		t.Fatalf("legacy secret: expected %d, got %d", http.StatusOK, status)
+	}
+	client := dbTypes.OAuthClient{}
+	models.DB.Where("id = ?", 1).First(&client)
+	if client.ClientSecret == testClientSecret {
+		t.Fatalf("expected the secret to be hashed after its first use")
+	}
+	if status := authenticate(testClientSecret); status != http.StatusOK {
+		t.Fatalf("hashed secret: expected %d, got %d", http.StatusOK, status)
+	}
+
+	rotated, err := clients.RegenerateSecret(1, testUser.CID, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("rotating secret: %s", err)
+	}
+	if status := authenticate(rotated.ClientSecret); status != http.StatusOK {
+		t.Fatalf("new secret: expected %d, got %d", http.StatusOK, status)
+	}
+	if status := authenticate(testClientSecret); status != http.StatusOK {
+		t.Fatalf("previous secret during rotation: expected %d, got %d", http.StatusOK, status)
+	}
+
+	if _, err := clients.RegenerateSecret(1, testUser.CID, 0, 0); err != nil {
+		t.Fatalf("rotating secret: %s", err)
+	}
+	if status := authenticate(rotated.ClientSecret); status != http.StatusUnauthorized {
+		t.Fatalf("secret rotated without overlap: expected %d, got %d", http.StatusUnauthorized, status)
+	}
+}
+
+func TestPerClientLifetimes(t *testing.T) {
+	f := setupFlow(t)
+
+	if err := f.configure(models.OAuthClientSettings{
+		AccessTokenLifetime:          60,
+		IDTokenLifetime:              120,
+		RefreshTokenIdleLifetime:     300,
+		RefreshTokenAbsoluteLifetime: 600,
+	}); err != nil {
+		t.Fatalf("creating client settings: %s", err)
+	}
+
+	body := f.login()
+	if body["expires_in"] != float64(60) {
+		t.Fatalf("token: expected expires_in 60, got %+v", body)
+	}
+
+	access := parseToken(t, body, "access_token")
+	if d := access.Expiration().Sub(access.IssuedAt()); d != time.Minute {
+		t.Fatalf("expected the access token to live a minute, got %s", d)
+	}
+	id := parseToken(t, body, "id_token")
+	if d := id.Expiration().Sub(id.IssuedAt()); d != 2*time.Minute {
+		t.Fatalf("expected the id token to live two minutes, got %s", d)
+	}
+
+	refresh := dbTypes.OAuthLogin{}
+	models.DB.Where("token = ?", body["refresh_token"]).First(&refresh)
+	if d := time.Until(refresh.ExpiresAt); d <= 4*time.Minute || d > 5*time.Minute {
+		t.Fatalf("expected the refresh token to expire in 5 minutes, got %s", d)
+	}
+	family := models.OAuthRefreshFamily{}
+	models.DB.Where("family_id = ?", loginpkg.FamilyOf(body["refresh_token"].(string))).First(&family)
+	if d := time.Until(family.ExpiresAt); d <= 9*time.Minute || d > 10*time.Minute {
+		t.Fatalf("expected the refresh token family to expire in 10 minutes, got %s", d)
+	}
+}
+
+func TestPublicClientRequiresPKCE(t *testing.T) {
+	f := setupFlow(t)
+
+	if err := f.configure(models.OAuthClientSettings{
+		ClientType: models.ClientTypePublic,
+		GrantTypes: models.DefaultGrantTypes,
+	}); err != nil {
+		t.Fatalf("creating client settings: %s", err)
+	}
+
+	params := authorizeParams("")
+	params.Del("code_challenge")
+	params.Del("code_challenge_method")
+	w := f.serve(httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+params.Encode(), nil))
+	if loc, _ := url.Parse(w.Header().Get("Location")); w.Code != http.StatusFound || loc.Query().Get("error") != "invalid_request" {
+		t.Fatalf("authorize without PKCE: expected invalid_request, got %d: %s", w.Code, w.Header().Get("Location"))
+	}
+
+	verifier, challenge := pkcePair()
+	ret := f.authorize(authorizeParams(challenge))
+
+	// The secret must not work for a public client
+	if status, _ := f.token(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {ret.Get("code")},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	}); status != http.StatusUnauthorized {
+		t.Fatalf("token with secret: expected %d, got %d", http.StatusUnauthorized, status)
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {testClientID},
+		"code":          {ret.Get("code")},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = f.serve(req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("token: expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	form.Set("grant_type", "client_credentials")
+	req = httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w = f.serve(req); w.Code == http.StatusOK {
+		t.Fatalf("client_credentials: expected a public client to be refused, got %s", w.Body.String())
+	}
+
+	if _, err := clients.RegenerateSecret(1, 0, 0, 0); !errors.Is(err, clients.ErrPublicClient) {
+		t.Fatalf("expected no secret for a public client, got %v", err)
+	}
+}
+
+func TestDeviceAuthorizationFlow(t *testing.T) {
+	f := setupFlow(t)
+
+	status, body := f.post("/oauth/device_authorization", url.Values{"scope": {"openid"}})
+	if status != http.StatusOK {
+		t.Fatalf("device authorization: expected %d, got %d: %+v", http.StatusOK, status, body)
+	}
+	deviceCode, userCode := body["device_code"].(string), body["user_code"].(string)
+
+	verify := func(form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/device", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		return f.serve(req)
+	}
+
+	// Entering the code only asks for confirmation
+	w := verify(url.Values{"user_code": {userCode}})
+	match := regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if w.Code != http.StatusOK || match == nil {
+		t.Fatalf("verify: expected a confirmation, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := verify(url.Values{"user_code": {userCode}, "action": {"approve"}, "csrf": {match[1]}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("approve without the csrf cookie: expected %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = verify(url.Values{"user_code": {userCode}, "action": {"approve"}, "csrf": {match[1]}}, w.Result().Cookies()...)
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("approve: expected %d, got %d: %s", http.StatusTemporaryRedirect, w.Code, w.Body.String())
+	}
+	cookies := w.Result().Cookies()
+	resp, err := f.noFollow.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("upstream authorize: %s", err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	if w := f.serve(req); w.Code != http.StatusOK {
+		t.Fatalf("callback: expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	poll := url.Values{"grant_type": {loginpkg.DeviceCodeGrantType}, "device_code": {deviceCode}}
+	if status, body := f.token(poll); status != http.StatusOK {
+		t.Fatalf("poll: expected %d, got %d: %+v", http.StatusOK, status, body)
+	}
+	if status, body := f.token(poll); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("second poll: expected invalid_grant, got %d: %+v", status, body)
+	}
+
+	// Guessing user codes is cut off
+	for i := 0; i < loginpkg.MaxUserCodeAttempts; i++ {
+		verify(url.Values{"user_code": {"BBBB-BBBB"}})
+	}
+	if w := verify(url.Values{"user_code": {"BBBB-BBBB"}}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("guessing: expected %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+}
+
+func TestIDTokenIsNotAnAccessToken(t *testing.T) {
+	f := setupFlow(t)
+	body := f.login()
+
+	for field, expected := range map[string]int{"access_token": http.StatusOK, "id_token": http.StatusUnauthorized} {
+		req := httptest.NewRequest(http.MethodGet, "/oauth/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+body[field].(string))
+		if w := f.serve(req); w.Code != expected {
+			t.Errorf("userinfo with the %s: expected %d, got %d", field, expected, w.Code)
+		}
+	}
+
+	if _, introspection := f.post("/oauth/introspect", url.Values{"token": {body["id_token"].(string)}}); introspection["active"] != false {
+		t.Errorf("introspecting the id token: expected it to be inactive, got %+v", introspection)
+	}
+}
@@ -11,6 +11,7 @@ require (
 	github.com/matoous/go-nanoid/v2 v2.0.0
 	github.com/robfig/cron/v3 v3.0.1
 	gorm.io/driver/mysql v1.4.3
+	gorm.io/driver/sqlite v1.4.3
 	gorm.io/gorm v1.24.1
 	hawton.dev/log4g v0.99.4
 )
@@ -34,11 +35,12 @@ require (
 	github.com/lestrrat-go/iter v1.0.2 // indirect
 	github.com/lestrrat-go/option v1.0.0 // indirect
 	github.com/mattn/go-isatty v0.0.16 // indirect
+	github.com/mattn/go-sqlite3 v1.14.15 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/pelletier/go-toml/v2 v2.0.5 // indirect
 	github.com/ugorji/go/codec v1.2.7 // indirect
-	golang.org/x/crypto v0.2.0 // indirect
+	golang.org/x/crypto v0.2.0
 	golang.org/x/net v0.2.0 // indirect
 	golang.org/x/sys v0.2.0 // indirect
 	golang.org/x/text v0.4.0 // indirect
@@ -0,0 +1,244 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/pkg/keys"
+	"github.com/adh-partnership/sso/utils"
+	"github.com/joho/godotenv"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+const keysUsage = `Usage: sso keys <command> [options]
+
+Commands:
+  generate --alg ALG [--out FILE] [--activate]
+        Generate a signing key. With --out the key is added to the private
+        JWKS in FILE (the SSO_JWKS format), otherwise it is stored in the
+        database as a pending key, or an active one with --activate. Keys
+        in the database are encrypted when SSO_KEY_ENCRYPTION_KEY is set.
+  list  List the keys in the database. Private material is never shown.
+  retire KID
+        Retire a key immediately, tokens it signed stop validating. When
+        it is the last active key of its algorithm the pending key takes
+        over and a new pending key is generated.
+  export-public [--out FILE]
+        Write the public JWKS of every published key, as served by
+        /oauth/certs, to stdout or FILE.
+`
+
+// connectKeysDatabase connects the subcommands that need the database, the
+// tests swap it for one of their own.
+var connectKeysDatabase = connectDatabase
+
+// runKeys runs the key management subcommands and returns the exit code.
+func runKeys(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, keysUsage)
+		return 2
+	}
+
+	if _, err := os.Stat(".env"); err == nil {
+		if err := godotenv.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading .env file: %s\n", err.Error())
+		}
+	}
+
+	var err error
+	if kek := utils.Getenv("SSO_KEY_ENCRYPTION_KEY", ""); kek != "" {
+		if keys.KEK, err = keys.ParseKEK(kek); err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing SSO_KEY_ENCRYPTION_KEY: %s\n", err.Error())
+			return 1
+		}
+	}
+
+	switch args[0] {
+	case "generate":
+		err = keysGenerate(args[1:])
+	case "list":
+		err = keysList(args[1:])
+	case "retire":
+		err = keysRetire(args[1:])
+	case "export-public":
+		err = keysExportPublic(args[1:])
+	default:
+		fmt.Fprint(os.Stderr, keysUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+func keysGenerate(args []string) error {
+	fs := flag.NewFlagSet("keys generate", flag.ContinueOnError)
+	alg := fs.String("alg", "RS256", "signing algorithm, one of RS256, RS384, RS512, ES256, ES384, ES512 or EdDSA")
+	out := fs.String("out", "", "add the key to the private JWKS in this file instead of the database")
+	activate := fs.Bool("activate", false, "store the key as active rather than pending")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *out == "" {
+		if err := connectKeysDatabase(); err != nil {
+			return err
+		}
+
+		state := models.KeyStatePending
+		if *activate {
+			state = models.KeyStateActive
+		}
+		sk, err := keys.Create(models.DB, jwa.SignatureAlgorithm(*alg), state)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Stored %s key %s as %s\n", sk.Algorithm, sk.KID, sk.State)
+		return nil
+	}
+
+	key, err := keys.Generate(jwa.SignatureAlgorithm(*alg))
+	if err != nil {
+		return err
+	}
+
+	set := jwk.NewSet()
+	if data, err := os.ReadFile(*out); err == nil {
+		if set, err = jwk.Parse(data); err != nil {
+			return fmt.Errorf("parsing %s: %w", *out, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	set.AddKey(key)
+
+	data, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(*out, data, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Added %s key %s to %s\n", key.Algorithm(), key.KeyID(), *out)
+
+	return nil
+}
+
+func keysList(args []string) error {
+	fs := flag.NewFlagSet("keys list", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := connectKeysDatabase(); err != nil {
+		return err
+	}
+
+	rows, err := keys.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KID\tALG\tSTATE\tCREATED\tACTIVATED\tRETIRING\tRETIRED")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			row.KID, row.Algorithm, row.State, row.CreatedAt.Format(time.RFC3339),
+			formatTime(row.ActivatedAt), formatTime(row.RetiringAt), formatTime(row.RetiredAt),
+		)
+	}
+
+	return w.Flush()
+}
+
+func keysRetire(args []string) error {
+	fs := flag.NewFlagSet("keys retire", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: sso keys retire KID")
+	}
+	if err := connectKeysDatabase(); err != nil {
+		return err
+	}
+
+	if err := keys.Retire(fs.Arg(0)); err != nil {
+		return err
+	}
+	fmt.Printf("Retired key %s\n", fs.Arg(0))
+
+	return nil
+}
+
+func keysExportPublic(args []string) error {
+	fs := flag.NewFlagSet("keys export-public", flag.ContinueOnError)
+	out := fs.String("out", "", "write the public JWKS to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := connectKeysDatabase(); err != nil {
+		return err
+	}
+
+	set, err := keys.PublicSet()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err = io.WriteString(os.Stdout, string(data)+"\n")
+		return err
+	}
+
+	return writeFileAtomic(*out, data, 0644)
+}
+
+// writeFileAtomic writes to a temporary file next to path and renames it over
+// path, so a crash never leaves a half written keyset behind.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,174 @@
+/*
+   ZAU Single Sign-On
+   Copyright (C) 2021  Daniel A. Hawton <daniel@hawton.org>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published
+   by the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/database/models/modelstest"
+	"github.com/adh-partnership/sso/pkg/keys"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+func setupKeysCLI(t *testing.T) {
+	t.Helper()
+
+	db := modelstest.Setup(t)
+
+	connect, kek := connectKeysDatabase, keys.KEK
+	t.Cleanup(func() { connectKeysDatabase, keys.KEK = connect, kek })
+	connectKeysDatabase = func() error {
+		models.DB = db
+		return nil
+	}
+}
+
+func keyStates(t *testing.T) map[string][]models.SigningKey {
+	t.Helper()
+
+	rows, err := keys.List()
+	if err != nil {
+		t.Fatalf("listing keys: %s", err)
+	}
+	ret := map[string][]models.SigningKey{}
+	for _, row := range rows {
+		ret[row.State] = append(ret[row.State], row)
+	}
+	return ret
+}
+
+func TestKeysCLI(t *testing.T) {
+	setupKeysCLI(t)
+	t.Setenv("SSO_KEY_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef")))
+
+	for _, args := range [][]string{
+		{"generate", "--alg", "ES256", "--activate"},
+		{"generate", "--alg", "ES256"},
+		{"list"},
+	} {
+		if code := runKeys(args); code != 0 {
+			t.Fatalf("keys %v: expected 0, got %d", args, code)
+		}
+	}
+	states := keyStates(t)
+	if len(states[models.KeyStateActive]) != 1 || len(states[models.KeyStatePending]) != 1 {
+		t.Fatalf("expected an active and a pending key, got %v", states)
+	}
+	if !strings.HasPrefix(states[models.KeyStateActive][0].PrivateJWK, "enc:") {
+		t.Errorf("expected the key to be stored encrypted with SSO_KEY_ENCRYPTION_KEY")
+	}
+
+	out := filepath.Join(t.TempDir(), "public.json")
+	if code := runKeys([]string{"export-public", "--out", out}); code != 0 {
+		t.Fatalf("keys export-public: expected 0, got %d", code)
+	}
+	if set := readKeySet(t, out); set.Len() != 2 {
+		t.Errorf("expected the active and pending key to be exported, got %d", set.Len())
+	} else if key, _ := set.Key(0); key.KeyType() != "EC" || hasPrivateKey(key) {
+		t.Errorf("expected only public keys to be exported, got %v", key)
+	}
+
+	// Retiring the only active key hands over to the pending key
+	active := states[models.KeyStateActive][0].KID
+	if code := runKeys([]string{"retire", active}); code != 0 {
+		t.Fatalf("keys retire: expected 0, got %d", code)
+	}
+	states = keyStates(t)
+	if len(states[models.KeyStateRetired]) != 1 || len(states[models.KeyStateActive]) != 1 || len(states[models.KeyStatePending]) != 1 {
+		t.Errorf("expected a retired, an active and a pending key, got %v", states)
+	}
+}
+
+func TestKeysCLIGenerateToFile(t *testing.T) {
+	setupKeysCLI(t)
+	connectKeysDatabase = func() error {
+		t.Errorf("expected keys generate --out not to use the database")
+		return errors.New("no database")
+	}
+	out := filepath.Join(t.TempDir(), "jwks.json")
+
+	for i := 0; i < 2; i++ {
+		if code := runKeys([]string{"generate", "--alg", "EdDSA", "--out", out}); code != 0 {
+			t.Fatalf("keys generate: expected 0, got %d", code)
+		}
+	}
+
+	set := readKeySet(t, out)
+	if set.Len() != 2 {
+		t.Fatalf("expected both keys in %s, got %d", out, set.Len())
+	}
+	if key, _ := set.Key(1); !hasPrivateKey(key) {
+		t.Errorf("expected private keys")
+	}
+}
+
+func TestKeysCLIErrors(t *testing.T) {
+	setupKeysCLI(t)
+
+	tests := []struct {
+		name string
+		args []string
+		env  string
+		want int
+	}{
+		{name: "no command", args: nil, want: 2},
+		{name: "unknown command", args: []string{"rotate"}, want: 2},
+		{name: "retire without a kid", args: []string{"retire"}, want: 1},
+		{name: "retire an unknown key", args: []string{"retire", "unknown"}, want: 1},
+		{name: "unsupported algorithm", args: []string{"generate", "--alg", "HS256"}, want: 1},
+		{name: "invalid key encryption key", args: []string{"list"}, env: "short", want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SSO_KEY_ENCRYPTION_KEY", tt.env)
+			if code := runKeys(tt.args); code != tt.want {
+				t.Errorf("keys %v: expected %d, got %d", tt.args, tt.want, code)
+			}
+		})
+	}
+}
+
+func readKeySet(t *testing.T, path string) jwk.Set {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %s", path, err)
+	}
+	set, err := jwk.Parse(data)
+	if err != nil {
+		t.Fatalf("parsing %s: %s", path, err)
+	}
+	return set
+}
+
+func hasPrivateKey(key jwk.Key) bool {
+	switch key.(type) {
+	case jwk.RSAPrivateKey, jwk.ECDSAPrivateKey, jwk.OKPPrivateKey:
+		return true
+	}
+	return false
+}
@@ -21,10 +21,18 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	v1 "github.com/adh-partnership/sso/controllers/v1"
 	"github.com/adh-partnership/sso/database/models"
 	"github.com/adh-partnership/sso/database/seed"
+	"github.com/adh-partnership/sso/pkg/idp"
+	"github.com/adh-partnership/sso/pkg/keys"
+	"github.com/adh-partnership/sso/pkg/login"
+	"github.com/adh-partnership/sso/pkg/scopes"
 	"github.com/adh-partnership/sso/pkg/tokens"
 	"github.com/adh-partnership/sso/utils"
 	"github.com/common-nighthawk/go-figure"
@@ -37,6 +45,10 @@ import (
 var log = log4g.Category("main")
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		os.Exit(runKeys(os.Args[2:]))
+	}
+
 	log4g.SetLogLevel(log4g.DEBUG)
 
 	intro := figure.NewFigure("ZDV SSO", "", false).Slicify()
@@ -66,43 +78,172 @@ func main() {
 	}
 
 	log.Info("Connecting to database and handling migrations")
-	models.Connect(models.DBOptions{
-		Driver:   utils.Getenv("DB_DRIVER", "mysql"),
-		Host:     utils.Getenv("DB_HOST", "localhost"),
-		Port:     utils.Getenv("DB_PORT", "3306"),
-		User:     utils.Getenv("DB_USERNAME", "root"),
-		Password: utils.Getenv("DB_PASSWORD", ""),
-		Database: utils.Getenv("DB_DATABASE", "sso"),
+	connectDatabase()
 
-		MaxOpenConns: 10,
-		MaxIdleConns: 1,
+	seed.CheckSeeds()
 
-		CACert: utils.Getenv("DB_CA_CERT", ""),
-	})
+	var err error
 
-	seed.CheckSeeds()
+	log.Info("Configuring upstream identity provider")
+	idp.Current, err = idp.New(utils.Getenv("VATSIM_USER_INFO_FORMAT", "sso"), idp.ConfigFromEnv())
+	if err != nil {
+		log.Error("Error configuring identity provider: " + err.Error())
+		os.Exit(1)
+	}
 
 	log.Info("Configuring Gin Server")
 	server := NewServer(appenv)
+	if utils.Getenv("SSO_ADMIN_CLIENT_IDS", "") == "" {
+		log.Warning("SSO_ADMIN_CLIENT_IDS is not set, the admin API refuses every token")
+	}
 
-	err := tokens.BuildKeyset(utils.Getenv("SSO_JWKS", ""))
+	log.Info("Loading signing keys")
+	if kek := utils.Getenv("SSO_KEY_ENCRYPTION_KEY", ""); kek != "" {
+		if keys.KEK, err = keys.ParseKEK(kek); err != nil {
+			log.Error("Error parsing SSO_KEY_ENCRYPTION_KEY: " + err.Error())
+			os.Exit(1)
+		}
+	} else {
+		log.Warning("SSO_KEY_ENCRYPTION_KEY is not set, signing keys are stored in the database in plaintext")
+	}
+	keyAlgs, err := keys.ParseAlgorithms(utils.Getenv("SSO_KEY_ALGORITHMS", "RS256"))
 	if err != nil {
-		log.Error("Error building keyset: " + err.Error())
+		log.Error("Error parsing SSO_KEY_ALGORITHMS: " + err.Error())
+		os.Exit(1)
+	}
+	if jwks := utils.Getenv("SSO_JWKS", ""); jwks != "" {
+		log.Warning("SSO_JWKS is deprecated, it leaks the private keys into the environment. Use SSO_KEYS_DIR or the database instead")
+		if n, err := keys.Import(jwks); err != nil {
+			log.Error("Error importing keys from SSO_JWKS: " + err.Error())
+		} else if n > 0 {
+			log.Info("Imported %d keys from SSO_JWKS", n)
+		}
+	}
+	// Keys in SSO_KEYS_DIR are managed by whoever mounts them, so only generate
+	// and rotate keys in the database when there is no directory
+	keys.Dir = utils.Getenv("SSO_KEYS_DIR", "")
+	if keys.Dir == "" {
+		if err := keys.Ensure(keyAlgs); err != nil {
+			log.Error("Error generating signing keys: " + err.Error())
+		}
+	}
+	if err := keys.Load(); err != nil {
+		log.Error("Error loading signing keys: " + err.Error())
+	}
+	log.Info("Loaded %d signing keys, publishing %d", tokens.Keys().Len(), tokens.PublicKeys().Len())
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := keys.Load(); err != nil {
+				log.Error("Error reloading signing keys, keeping the current keys: " + err.Error())
+				continue
+			}
+			log.Info("Reloaded %d signing keys on SIGHUP", tokens.Keys().Len())
+		}
+	}()
+	go keys.Watch(10 * time.Second)
+
+	if path := utils.Getenv("SSO_SCOPES_FILE", ""); path != "" {
+		if err := scopes.LoadFile(path); err != nil {
+			log.Error("Error loading scopes from %s: %s", path, err.Error())
+		}
+	}
+	log.Info("Registered %d scopes", len(scopes.Registry))
+
+	if lifetime := utils.Getenv("SSO_AUTHORIZATION_CODE_LIFETIME", ""); lifetime != "" {
+		d, err := time.ParseDuration(lifetime)
+		if err != nil || d <= 0 {
+			log.Error("Invalid SSO_AUTHORIZATION_CODE_LIFETIME %q, using %s", lifetime, login.AuthorizationCodeLifetime)
+		} else {
+			login.AuthorizationCodeLifetime = d
+		}
 	}
-	log.Info("Built JWKS with %d keys", tokens.KeySet.Len())
 
 	log.Info("Configuring scheduled jobs")
 	jobs := cron.New()
 	jobs.AddFunc("@every 1m", func() {
-		if err := models.DB.Where("code <> '' and now() >= date_add(created_at, interval 30 minute)").Delete(&dbTypes.OAuthLogin{}).Error; err != nil {
-			log4g.Category("job/cleanup").Error(fmt.Sprintf("Error cleaning up old codes: %s", err.Error()))
-		}
+		// Pending logins, codes and refresh tokens all carry their own expiry
 		if err := models.DB.Where("now() >= expires_at").Delete(&dbTypes.OAuthLogin{}).Error; err != nil {
 			log4g.Category("job/cleanup").Error(fmt.Sprintf("Error cleaning up expired codes: %s", err.Error()))
 		}
+		if err := models.DB.Where("now() >= expires_at").Delete(&models.OAuthDeviceCode{}).Error; err != nil {
+			log4g.Category("job/cleanup").Error(fmt.Sprintf("Error cleaning up expired device codes: %s", err.Error()))
+		}
+		if err := models.DB.Where("now() >= expires_at").Delete(&models.OAuthDeviceAttempt{}).Error; err != nil {
+			log4g.Category("job/cleanup").Error(fmt.Sprintf("Error cleaning up device code attempts: %s", err.Error()))
+		}
+		if err := models.DB.Where("now() >= expires_at").Delete(&models.OAuthRevokedToken{}).Error; err != nil {
+			log4g.Category("job/cleanup").Error(fmt.Sprintf("Error cleaning up revoked tokens: %s", err.Error()))
+		}
+		if err := models.DB.Where("now() >= expires_at").Delete(&models.OAuthAccessToken{}).Error; err != nil {
+			log4g.Category("job/cleanup").Error(fmt.Sprintf("Error cleaning up expired reference tokens: %s", err.Error()))
+		}
+		if err := models.DB.Where("now() >= expires_at").Delete(&models.OAuthClientAssertion{}).Error; err != nil {
+			log4g.Category("job/cleanup").Error(fmt.Sprintf("Error cleaning up client assertions: %s", err.Error()))
+		}
+		if err := models.DB.Where("now() >= expires_at").Delete(&models.OAuthInitialAccessToken{}).Error; err != nil {
+			log4g.Category("job/cleanup").Error(fmt.Sprintf("Error cleaning up initial access tokens: %s", err.Error()))
+		}
+		if err := models.DB.Model(&models.OAuthClientSecret{}).Where("now() >= previous_expires_at").Updates(map[string]interface{}{"previous": "", "previous_expires_at": nil}).Error; err != nil {
+			log4g.Category("job/cleanup").Error(fmt.Sprintf("Error cleaning up rotated client secrets: %s", err.Error()))
+		}
+		if err := models.DB.Where("now() >= expires_at").Delete(&models.OAuthRefreshFamily{}).Error; err != nil {
+			log4g.Category("job/cleanup").Error(fmt.Sprintf("Error cleaning up refresh token families: %s", err.Error()))
+		}
+		if err := models.DB.Where("family_id NOT IN (?)", models.DB.Model(&models.OAuthRefreshFamily{}).Select("family_id")).Delete(&models.OAuthRefreshToken{}).Error; err != nil {
+			log4g.Category("job/cleanup").Error(fmt.Sprintf("Error cleaning up refresh token history: %s", err.Error()))
+		}
+	})
+	// Other replicas may have rotated, pick up their keys
+	jobs.AddFunc("@every 1m", func() {
+		if err := keys.Load(); err != nil {
+			log4g.Category("job/keys").Error(fmt.Sprintf("Error reloading signing keys: %s", err.Error()))
+		}
 	})
+	if keys.Dir == "" {
+		schedule, err := cron.ParseStandard(utils.Getenv("SSO_KEY_ROTATION_SCHEDULE", "@weekly"))
+		if err != nil {
+			log.Error("Error scheduling key rotation: " + err.Error())
+		} else {
+			jobs.Schedule(schedule, cron.FuncJob(func() {
+				if err := keys.Rotate(keyAlgs); err != nil {
+					log4g.Category("job/keys").Error(fmt.Sprintf("Error rotating signing keys: %s", err.Error()))
+				}
+			}))
+			v1.CertsMaxAge = certsMaxAge(schedule)
+		}
+	}
 	jobs.Start()
 
 	log.Info("Done with setup, starting web server...")
 	server.engine.Run(fmt.Sprintf(":%s", utils.Getenv("PORT", "3000")))
 }
+
+func connectDatabase() error {
+	return models.Connect(models.DBOptions{
+		Driver:   utils.Getenv("DB_DRIVER", "mysql"),
+		Host:     utils.Getenv("DB_HOST", "localhost"),
+		Port:     utils.Getenv("DB_PORT", "3306"),
+		User:     utils.Getenv("DB_USERNAME", "root"),
+		Password: utils.Getenv("DB_PASSWORD", ""),
+		Database: utils.Getenv("DB_DATABASE", "sso"),
+
+		MaxOpenConns: 10,
+		MaxIdleConns: 1,
+
+		CACert: utils.Getenv("DB_CA_CERT", ""),
+	})
+}
+
+// certsMaxAge caches the JWKS for half a rotation, leaving time for relying
+// parties to fetch a pending key before it signs, capped at a day.
+func certsMaxAge(schedule cron.Schedule) time.Duration {
+	next := schedule.Next(time.Now())
+	age := schedule.Next(next).Sub(next) / 2
+	if age > 24*time.Hour {
+		age = 24 * time.Hour
+	}
+	return age
+}
@@ -21,14 +21,12 @@ package jwt
 import (
 	"errors"
 	"net/http"
-	"os"
 	"strconv"
 
 	dbTypes "github.com/adh-partnership/api/pkg/database/models"
 	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/pkg/login"
 	"github.com/gin-gonic/gin"
-	"github.com/lestrrat-go/jwx/v2/jwk"
-	"github.com/lestrrat-go/jwx/v2/jwt"
 	"gorm.io/gorm/clause"
 	"hawton.dev/log4g"
 )
@@ -51,23 +49,18 @@ func Auth(c *gin.Context) {
 	}
 
 	tokenString := authHeader[len(BEARER_SCHEMA):]
-	keyset, err := jwk.Parse([]byte(os.Getenv("SSO_JWKS")))
-	if err != nil {
-		HandleRet(c, http.StatusUnauthorized, "Unauthorized")
-		return
-	}
 	log.Debug("Token '%s'", tokenString)
-	pubkeyset, _ := jwk.PublicSetOf(keyset)
-	token, err := jwt.Parse([]byte(tokenString), jwt.WithKeySet(pubkeyset), jwt.WithValidate(true))
+	// JWT or reference token, revoked ones included
+	token, err := login.ResolveAccessToken(tokenString)
 	if err != nil {
 		log.Warning("Bad token passed: %s // %s", err.Error(), tokenString)
 		HandleRet(c, http.StatusForbidden, "Forbidden")
 		return
 	}
 
-	cid, err := strconv.ParseUint(token.Subject(), 10, 32)
+	cid, err := strconv.ParseUint(token.Subject, 10, 32)
 	if err != nil {
-		log.Warning("Cannot convert subject to int, bad! %s // %s // %s", err.Error(), token.Subject(), tokenString)
+		log.Warning("Cannot convert subject to int, bad! %s // %s // %s", err.Error(), token.Subject, tokenString)
 		HandleRet(c, http.StatusForbidden, "Forbidden")
 		return
 	}
@@ -80,6 +73,7 @@ func Auth(c *gin.Context) {
 	}
 
 	c.Set("x-user", user)
+	c.Set("x-token", token)
 	c.Next()
 }
 
@@ -92,3 +86,51 @@ func HandleRet(c *gin.Context, ret int, msg string) {
 		c.Abort()
 	}
 }
+
+// RequireRole only lets users with one of roles through, it must run after Auth.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := c.Keys["x-user"].(*dbTypes.User)
+		if user == nil {
+			HandleRet(c, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		for _, role := range user.Roles {
+			for _, name := range roles {
+				if role.Name == name {
+					c.Next()
+					return
+				}
+			}
+		}
+
+		log.Warning("User %d is missing one of the roles %v for %s", user.CID, roles, c.Request.URL.Path)
+		c.JSON(http.StatusForbidden, gin.H{"message": "Forbidden"})
+		c.Abort()
+	}
+}
+
+// RequireClient only lets access tokens issued to one of clientIDs through, it
+// must run after Auth. Without it any client a user logs in to could use their
+// token here.
+func RequireClient(clientIDs ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Keys["x-token"].(*login.AccessToken)
+		if token == nil {
+			HandleRet(c, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		for _, id := range clientIDs {
+			if id != "" && token.ClientID == id {
+				c.Next()
+				return
+			}
+		}
+
+		log.Warning("Token for %s issued to client %q may not be used for %s", token.Subject, token.ClientID, c.Request.URL.Path)
+		c.JSON(http.StatusForbidden, gin.H{"message": "Forbidden"})
+		c.Abort()
+	}
+}
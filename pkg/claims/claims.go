@@ -0,0 +1,185 @@
+package claims
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+)
+
+// Where a mapped claim is added
+const (
+	TargetAccessToken = "access_token"
+	TargetIDToken     = "id_token"
+	TargetUserinfo    = "userinfo"
+)
+
+// Types a mapped claim can be converted to, empty keeps the source's type
+const (
+	TypeString  = "string"
+	TypeNumber  = "number"
+	TypeBoolean = "boolean"
+	TypeArray   = "array"
+)
+
+var (
+	ErrInvalidClaim  = errors.New("invalid claim name")
+	ErrInvalidSource = errors.New("unknown claim source")
+	ErrInvalidType   = errors.New("unknown claim type")
+	ErrInvalidTarget = errors.New("unknown claim target")
+	ErrIncompatible  = errors.New("claim source can't be converted to type")
+)
+
+// Claims the protocol sets itself and a mapping can't override
+var reserved = []string{"iss", "sub", "aud", "exp", "iat", "nbf", "jti", "nonce", "azp", "auth_time", "client_id", "scope", "gty"}
+
+// Sources are the user fields a claim can be mapped from.
+var Sources = map[string]func(*dbTypes.User) interface{}{
+	"cid":                      func(u *dbTypes.User) interface{} { return u.CID },
+	"name":                     func(u *dbTypes.User) interface{} { return fmt.Sprintf("%s %s", u.FirstName, u.LastName) },
+	"first_name":               func(u *dbTypes.User) interface{} { return u.FirstName },
+	"last_name":                func(u *dbTypes.User) interface{} { return u.LastName },
+	"email":                    func(u *dbTypes.User) interface{} { return u.Email },
+	"operating_initials":       func(u *dbTypes.User) interface{} { return u.OperatingInitials },
+	"controller_type":          func(u *dbTypes.User) interface{} { return u.ControllerType },
+	"status":                   func(u *dbTypes.User) interface{} { return u.Status },
+	"region":                   func(u *dbTypes.User) interface{} { return u.Region },
+	"division":                 func(u *dbTypes.User) interface{} { return u.Division },
+	"subdivision":              func(u *dbTypes.User) interface{} { return u.Subdivision },
+	"discord_id":               func(u *dbTypes.User) interface{} { return u.DiscordID },
+	"rating.id":                func(u *dbTypes.User) interface{} { return u.Rating.ID },
+	"rating.short":             func(u *dbTypes.User) interface{} { return u.Rating.Short },
+	"rating.long":              func(u *dbTypes.User) interface{} { return u.Rating.Long },
+	"roles":                    roles,
+	"certifications":           certifications,
+	"certifications.gnd":       func(u *dbTypes.User) interface{} { return u.GndCertification },
+	"certifications.major_gnd": func(u *dbTypes.User) interface{} { return u.MajorGndCertification },
+	"certifications.lcl":       func(u *dbTypes.User) interface{} { return u.LclCertification },
+	"certifications.major_lcl": func(u *dbTypes.User) interface{} { return u.MajorLclCertification },
+	"certifications.app":       func(u *dbTypes.User) interface{} { return u.AppCertification },
+	"certifications.major_app": func(u *dbTypes.User) interface{} { return u.MajorAppCertification },
+	"certifications.ctr":       func(u *dbTypes.User) interface{} { return u.CtrCertification },
+}
+
+// Mapping adds the user field Source to tokens as Claim.
+type Mapping struct {
+	Claim   string   `json:"claim"`
+	Source  string   `json:"source"`
+	Type    string   `json:"type,omitempty"`
+	Targets []string `json:"targets,omitempty"` // Empty adds the claim everywhere
+	Scope   string   `json:"scope,omitempty"`   // Only add the claim when this scope was granted
+}
+
+// Mappings is stored as JSON on the client settings.
+type Mappings []Mapping
+
+func (m Mappings) Validate() error {
+	for _, mapping := range m {
+		if mapping.Claim == "" || contains(reserved, mapping.Claim) {
+			return fmt.Errorf("%w: %q", ErrInvalidClaim, mapping.Claim)
+		}
+		if _, ok := Sources[mapping.Source]; !ok {
+			return fmt.Errorf("%w: %q", ErrInvalidSource, mapping.Source)
+		}
+		switch mapping.Type {
+		case "", TypeString, TypeNumber, TypeBoolean, TypeArray:
+		default:
+			return fmt.Errorf("%w: %q", ErrInvalidType, mapping.Type)
+		}
+		if !Convertible(mapping.Source, mapping.Type) {
+			return fmt.Errorf("%w: %q to %q", ErrIncompatible, mapping.Source, mapping.Type)
+		}
+		for _, target := range mapping.Targets {
+			if target != TargetAccessToken && target != TargetIDToken && target != TargetUserinfo {
+				return fmt.Errorf("%w: %q", ErrInvalidTarget, target)
+			}
+		}
+	}
+	return nil
+}
+
+// Convertible reports whether values of source can be converted to typ.
+// Objects are only ever mapped as they are, and only numeric sources convert
+// to numbers.
+func Convertible(source, typ string) bool {
+	get, ok := Sources[source]
+	if !ok {
+		return false
+	}
+	switch get(&dbTypes.User{}).(type) {
+	case map[string]string:
+		return typ == ""
+	case string, []string:
+		return typ != TypeNumber
+	}
+	return true
+}
+
+// AppliesTo reports whether the mapping adds its claim to target when the
+// given scopes were granted.
+func (m Mapping) AppliesTo(target string, granted []string) bool {
+	if len(m.Targets) > 0 && !contains(m.Targets, target) {
+		return false
+	}
+	return m.Scope == "" || contains(granted, m.Scope)
+}
+
+func (m Mappings) Value() (driver.Value, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	ba, err := json.Marshal([]Mapping(m))
+	return string(ba), err
+}
+
+func (m *Mappings) Scan(val interface{}) error {
+	var ba []byte
+	switch v := val.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case []byte:
+		ba = v
+	case string:
+		ba = []byte(v)
+	default:
+		return errors.New(fmt.Sprint("Failed to unmarshal claim mappings:", val))
+	}
+
+	var t []Mapping
+	err := json.Unmarshal(ba, &t)
+	*m = Mappings(t)
+	return err
+}
+
+func roles(u *dbTypes.User) interface{} {
+	names := []string{}
+	for _, role := range u.Roles {
+		names = append(names, role.Name)
+	}
+	return names
+}
+
+func certifications(u *dbTypes.User) interface{} {
+	return map[string]string{
+		"gnd":       u.GndCertification,
+		"major_gnd": u.MajorGndCertification,
+		"lcl":       u.LclCertification,
+		"major_lcl": u.MajorLclCertification,
+		"app":       u.AppCertification,
+		"major_app": u.MajorAppCertification,
+		"ctr":       u.CtrCertification,
+	}
+}
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package claims
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMappingsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping Mapping
+		wantErr error
+	}{
+		{name: "source as is", mapping: Mapping{Claim: "certs", Source: "certifications"}},
+		{name: "string to array", mapping: Mapping{Claim: "c", Source: "certifications.gnd", Type: TypeArray}},
+		{name: "string to boolean", mapping: Mapping{Claim: "c", Source: "certifications.gnd", Type: TypeBoolean}},
+		{name: "number to string", mapping: Mapping{Claim: "c", Source: "cid", Type: TypeString}},
+		{name: "rating to number", mapping: Mapping{Claim: "c", Source: "rating.id", Type: TypeNumber}},
+		{name: "list to string", mapping: Mapping{Claim: "c", Source: "roles", Type: TypeString}},
+		{name: "with targets", mapping: Mapping{Claim: "c", Source: "cid", Targets: []string{TargetIDToken, TargetUserinfo}}},
+		{name: "empty claim", mapping: Mapping{Source: "cid"}, wantErr: ErrInvalidClaim},
+		{name: "reserved claim", mapping: Mapping{Claim: "sub", Source: "cid"}, wantErr: ErrInvalidClaim},
+		{name: "grant type claim", mapping: Mapping{Claim: "gty", Source: "cid"}, wantErr: ErrInvalidClaim},
+		{name: "unknown source", mapping: Mapping{Claim: "c", Source: "password"}, wantErr: ErrInvalidSource},
+		{name: "unknown type", mapping: Mapping{Claim: "c", Source: "cid", Type: "object"}, wantErr: ErrInvalidType},
+		{name: "unknown target", mapping: Mapping{Claim: "c", Source: "cid", Targets: []string{"logout_token"}}, wantErr: ErrInvalidTarget},
+		{name: "object to array", mapping: Mapping{Claim: "c", Source: "certifications", Type: TypeArray}, wantErr: ErrIncompatible},
+		{name: "object to string", mapping: Mapping{Claim: "c", Source: "certifications", Type: TypeString}, wantErr: ErrIncompatible},
+		{name: "object to boolean", mapping: Mapping{Claim: "c", Source: "certifications", Type: TypeBoolean}, wantErr: ErrIncompatible},
+		{name: "string to number", mapping: Mapping{Claim: "c", Source: "email", Type: TypeNumber}, wantErr: ErrIncompatible},
+		{name: "list to number", mapping: Mapping{Claim: "c", Source: "roles", Type: TypeNumber}, wantErr: ErrIncompatible},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := (Mappings{tt.mapping}).Validate(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,510 @@
+package clients
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/datatypes"
+	"github.com/adh-partnership/sso/database/models"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"gorm.io/gorm"
+)
+
+// Audit actions
+const (
+	ActionCreate           = "create"
+	ActionUpdate           = "update"
+	ActionDelete           = "delete"
+	ActionRegenerateSecret = "regenerate_secret"
+)
+
+const DefaultTTL = 3600
+
+var (
+	ErrNotFound           = errors.New("client not found")
+	ErrInvalidName        = errors.New("name is required")
+	ErrDuplicateName      = errors.New("name is already used by another client")
+	ErrInvalidTTL         = errors.New("ttl must be positive")
+	ErrInvalidRedirectURI = errors.New("invalid redirect uri")
+	ErrInvalidFetchURI    = errors.New("invalid uri")
+	ErrInvalidSettings    = errors.New("invalid settings")
+	ErrPublicClient       = errors.New("public clients don't have a secret")
+)
+
+// Client is a client as it is managed through the API. ClientSecret is only
+// set right after the secret was generated, it can't be read back later.
+// Public clients never get one.
+type Client struct {
+	ID           uint                        `json:"id"`
+	Name         string                      `json:"name"`
+	ClientID     string                      `json:"client_id"`
+	ClientSecret string                      `json:"client_secret,omitempty"`
+	RedirectURIs []string                    `json:"redirect_uris"`
+	TTL          int                         `json:"ttl"`
+	Settings     *models.OAuthClientSettings `json:"settings,omitempty"`
+	CreatedAt    time.Time                   `json:"created_at"`
+	UpdatedAt    time.Time                   `json:"updated_at"`
+
+	ClientSecretExpiresAt   *time.Time `json:"client_secret_expires_at,omitempty"`
+	PreviousSecretExpiresAt *time.Time `json:"previous_secret_expires_at,omitempty"` // Set while the previous secret still works
+}
+
+func List() ([]Client, error) {
+	var rows []dbTypes.OAuthClient
+	if err := models.DB.Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	ret := []Client{}
+	for i := range rows {
+		client, err := fromRow(models.DB, &rows[i])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *client)
+	}
+	return ret, nil
+}
+
+func Get(id uint) (*Client, error) {
+	row, err := find(models.DB, id)
+	if err != nil {
+		return nil, err
+	}
+	return fromRow(models.DB, row)
+}
+
+// Create registers a new client with a generated client id and secret. actor
+// is the CID of the user making the change. Clients created without allowed
+// scopes only get openid.
+func Create(in *Client, actor uint) (*Client, error) {
+	if in.Settings == nil {
+		in.Settings = &models.OAuthClientSettings{}
+	}
+	if len(in.Settings.AllowedScopes) == 0 {
+		in.Settings.AllowedScopes = datatypes.JSONMap{"openid"}
+	}
+	if err := validate(in); err != nil {
+		return nil, err
+	}
+
+	clientID, err := gonanoid.New(32)
+	if err != nil {
+		return nil, err
+	}
+	uris, err := json.Marshal(in.RedirectURIs)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := in.Settings
+	var secret, stored string
+	if !settings.IsPublic() {
+		if secret, err = generateSecret(); err != nil {
+			return nil, err
+		}
+		if stored, err = storedSecret(settings, secret); err != nil {
+			return nil, err
+		}
+	}
+
+	row := dbTypes.OAuthClient{
+		Name:         in.Name,
+		ClientID:     clientID,
+		ClientSecret: stored,
+		RedirectURIs: string(uris),
+		TTL:          in.TTL,
+	}
+
+	var ret *Client
+	err = models.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkName(tx, in.Name, 0); err != nil {
+			return err
+		}
+		if err := tx.Create(&row).Error; err != nil {
+			return err
+		}
+		if err := saveSettings(tx, row.ID, in.Settings); err != nil {
+			return err
+		}
+
+		ret, err = audited(tx, &row, ActionCreate, actor)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret.ClientSecret = secret
+	return ret, nil
+}
+
+// Update replaces the name, redirect uris, ttl and, when given, the settings
+// of the client. The client id and secret can't be changed this way, except
+// that making a client public drops its secret and switching it to
+// client_secret_jwt issues a new one, a hashed secret can't verify
+// assertions. The new secret is only shown on the returned client.
+func Update(id uint, in *Client, actor uint) (*Client, error) {
+	if err := validate(in); err != nil {
+		return nil, err
+	}
+	var secret string
+
+	uris, err := json.Marshal(in.RedirectURIs)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret *Client
+	err = models.DB.Transaction(func(tx *gorm.DB) error {
+		row, err := find(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkName(tx, in.Name, id); err != nil {
+			return err
+		}
+
+		// Name is part of the primary key, so Save would insert a new row
+		if err := tx.Model(&dbTypes.OAuthClient{}).Where("id = ?", id).Select("Name", "RedirectURIs", "TTL").Updates(dbTypes.OAuthClient{
+			Name:         in.Name,
+			RedirectURIs: string(uris),
+			TTL:          in.TTL,
+		}).Error; err != nil {
+			return err
+		}
+		if err := saveSettings(tx, id, in.Settings); err != nil {
+			return err
+		}
+		if in.Settings != nil && keepsPlaintext(in.Settings) && (row.ClientSecret == "" || isHashed(row.ClientSecret)) {
+			if secret, err = generateSecret(); err != nil {
+				return err
+			}
+			if err := rotateSecret(tx, row, secret, 0, 0); err != nil {
+				return err
+			}
+		}
+		// A client turned public must not keep authenticating with its secret
+		if in.Settings != nil && in.Settings.IsPublic() {
+			if err := tx.Model(&dbTypes.OAuthClient{}).Where("id = ?", id).Update("client_secret", "").Error; err != nil {
+				return err
+			}
+			if err := tx.Where("client_id = ?", id).Delete(&models.OAuthClientSecret{}).Error; err != nil {
+				return err
+			}
+		}
+
+		if row, err = find(tx, id); err != nil {
+			return err
+		}
+		ret, err = audited(tx, row, ActionUpdate, actor)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret.ClientSecret = secret
+	return ret, nil
+}
+
+// Delete removes the client and everything issued to it.
+func Delete(id uint, actor uint) error {
+	return models.DB.Transaction(func(tx *gorm.DB) error {
+		row, err := find(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if _, err := audited(tx, row, ActionDelete, actor); err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.OAuthRefreshFamily{}).Where("client_id = ? AND revoked_at IS NULL", id).Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("client_id = ?", id).Delete(&dbTypes.OAuthLogin{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("client_id = ?", id).Delete(&models.OAuthDeviceCode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("client_id = ?", row.ClientID).Delete(&models.OAuthAccessToken{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("client_id = ?", id).Delete(&models.OAuthClientSettings{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("client_id = ?", id).Delete(&models.OAuthClientRegistration{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("client_id = ?", id).Delete(&models.OAuthClientSecret{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&dbTypes.OAuthClient{}).Error
+	})
+}
+
+// RegenerateSecret replaces the client's secret. The old secret keeps working
+// for previousTTL so clients can be moved over without downtime, the new one
+// expires after ttl, zero meaning never for both. The returned client is the
+// only place the new secret is shown.
+func RegenerateSecret(id uint, actor uint, previousTTL, ttl time.Duration) (*Client, error) {
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret *Client
+	err = models.DB.Transaction(func(tx *gorm.DB) error {
+		row, err := find(tx, id)
+		if err != nil {
+			return err
+		}
+
+		settings := models.OAuthClientSettings{}
+		if err := tx.Where("client_id = ?", id).First(&settings).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if settings.IsPublic() {
+			return ErrPublicClient
+		}
+		stored, err := storedSecret(&settings, secret)
+		if err != nil {
+			return err
+		}
+		if err := rotateSecret(tx, row, stored, previousTTL, ttl); err != nil {
+			return err
+		}
+
+		ret, err = audited(tx, row, ActionRegenerateSecret, actor)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret.ClientSecret = secret
+	return ret, nil
+}
+
+// ValidateFetchURI checks a URI the SSO fetches from for a client, its
+// jwks_uri or one of its request_uris. It must be a full https URL with a
+// host, and may not carry credentials or a fragment.
+func ValidateFetchURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("%w: %q is not an https url", ErrInvalidFetchURI, uri)
+	}
+	if u.User != nil || u.Fragment != "" || strings.Contains(uri, "#") {
+		return fmt.Errorf("%w: %q has credentials or a fragment", ErrInvalidFetchURI, uri)
+	}
+	return nil
+}
+
+// ValidateRedirectURI checks uri is an absolute URI without a fragment or
+// wildcard. Plain http is only allowed for loopback redirects and custom
+// schemes must be reverse domain names, as RFC8252 asks of native apps.
+func ValidateRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() {
+		return fmt.Errorf("%w: %q is not an absolute uri", ErrInvalidRedirectURI, uri)
+	}
+	if u.Fragment != "" || strings.Contains(uri, "#") {
+		return fmt.Errorf("%w: %q has a fragment", ErrInvalidRedirectURI, uri)
+	}
+	if strings.Contains(uri, "*") {
+		return fmt.Errorf("%w: %q has a wildcard", ErrInvalidRedirectURI, uri)
+	}
+
+	switch u.Scheme {
+	case "https":
+		if u.Host == "" {
+			return fmt.Errorf("%w: %q has no host", ErrInvalidRedirectURI, uri)
+		}
+	case "http":
+		if !isLoopback(u.Hostname()) {
+			return fmt.Errorf("%w: %q must use https", ErrInvalidRedirectURI, uri)
+		}
+	default:
+		if !strings.Contains(u.Scheme, ".") {
+			return fmt.Errorf("%w: %q has an unsupported scheme", ErrInvalidRedirectURI, uri)
+		}
+	}
+
+	return nil
+}
+
+func validate(in *Client) error {
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" {
+		return ErrInvalidName
+	}
+	if in.TTL == 0 {
+		in.TTL = DefaultTTL
+	}
+	if in.TTL < 0 {
+		return ErrInvalidTTL
+	}
+	if in.RedirectURIs == nil {
+		in.RedirectURIs = []string{}
+	}
+	for _, uri := range in.RedirectURIs {
+		if err := ValidateRedirectURI(uri); err != nil {
+			return err
+		}
+	}
+	if in.Settings != nil {
+		if in.Settings.JWKSURI != "" {
+			if err := ValidateFetchURI(in.Settings.JWKSURI); err != nil {
+				return fmt.Errorf("%w: jwks_uri: %s", ErrInvalidSettings, err.Error())
+			}
+		}
+		for _, uri := range in.Settings.RequestURIs {
+			if err := ValidateFetchURI(uri); err != nil {
+				return fmt.Errorf("%w: request_uris: %s", ErrInvalidSettings, err.Error())
+			}
+		}
+		// Only clients from before allowed scopes get every scope by default
+		if len(in.Settings.AllowedScopes) == 0 {
+			return fmt.Errorf("%w: allowed_scopes is required, %q allows every scope", ErrInvalidSettings, models.AllScopes)
+		}
+		if err := in.Settings.BeforeSave(nil); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidSettings, err.Error())
+		}
+	}
+	return nil
+}
+
+// IsInvalid reports whether err means the client failed validation.
+func IsInvalid(err error) bool {
+	return errors.Is(err, ErrInvalidName) || errors.Is(err, ErrDuplicateName) || errors.Is(err, ErrInvalidTTL) || errors.Is(err, ErrInvalidRedirectURI) || errors.Is(err, ErrInvalidSettings) || errors.Is(err, ErrPublicClient)
+}
+
+// checkName makes sure no client but id is called name, tokens are addressed
+// to the client's name.
+func checkName(tx *gorm.DB, name string, id uint) error {
+	var count int64
+	if err := tx.Model(&dbTypes.OAuthClient{}).Where("name = ? AND id <> ?", name, id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %q", ErrDuplicateName, name)
+	}
+	return nil
+}
+
+// saveSettings stores settings for the client, nil leaves them as they are.
+func saveSettings(tx *gorm.DB, id uint, settings *models.OAuthClientSettings) error {
+	if settings == nil {
+		return nil
+	}
+
+	existing := models.OAuthClientSettings{}
+	if err := tx.Where("client_id = ?", id).First(&existing).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	settings.ID = existing.ID
+	settings.ClientID = id
+	settings.CreatedAt = existing.CreatedAt
+	return tx.Save(settings).Error
+}
+
+// audited records action against the client and returns it as the API shows it.
+func audited(tx *gorm.DB, row *dbTypes.OAuthClient, action string, actor uint) (*Client, error) {
+	client, err := fromRow(tx, row)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := json.Marshal(client)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Create(&models.OAuthClientAudit{
+		ClientID: row.ID,
+		Action:   action,
+		CID:      actor,
+		Changes:  string(changes),
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func find(tx *gorm.DB, id uint) (*dbTypes.OAuthClient, error) {
+	row := dbTypes.OAuthClient{}
+	if err := tx.Where("id = ?", id).First(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &row, nil
+}
+
+func fromRow(tx *gorm.DB, row *dbTypes.OAuthClient) (*Client, error) {
+	uris := []string{}
+	if row.RedirectURIs != "" {
+		if err := json.Unmarshal([]byte(row.RedirectURIs), &uris); err != nil {
+			return nil, fmt.Errorf("client %d has invalid redirect uris: %w", row.ID, err)
+		}
+	}
+
+	settings := models.OAuthClientSettings{ClientID: row.ID}
+	if err := tx.Where("client_id = ?", row.ID).First(&settings).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	rotation, err := getRotation(tx, row.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Client{
+		ID:                    row.ID,
+		Name:                  row.Name,
+		ClientID:              row.ClientID,
+		RedirectURIs:          uris,
+		TTL:                   row.TTL,
+		Settings:              &settings,
+		CreatedAt:             row.CreatedAt,
+		UpdatedAt:             row.UpdatedAt,
+		ClientSecretExpiresAt: rotation.ExpiresAt,
+	}
+	if rotation.Previous != "" && rotation.PreviousExpiresAt != nil && time.Now().Before(*rotation.PreviousExpiresAt) {
+		ret.PreviousSecretExpiresAt = rotation.PreviousExpiresAt
+	}
+	return ret, nil
+}
+
+func generateSecret() (string, error) {
+	return gonanoid.New(48)
+}
+
+// isInternal reports whether host is an address only reachable from inside,
+// a registered client must not make us fetch from those.
+func isInternal(host string) bool {
+	if isLoopback(host) || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified())
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
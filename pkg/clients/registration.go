@@ -0,0 +1,315 @@
+package clients
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/datatypes"
+	"github.com/adh-partnership/sso/database/models"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+)
+
+var (
+	ErrInvalidToken          = errors.New("invalid_token")
+	ErrInvalidClientMetadata = errors.New("invalid_client_metadata")
+)
+
+// Metadata is the RFC7591 client metadata accepted by the registration
+// endpoint.
+type Metadata struct {
+	ClientName              string          `json:"client_name"`
+	RedirectURIs            []string        `json:"redirect_uris"`
+	GrantTypes              []string        `json:"grant_types,omitempty"`
+	ResponseTypes           []string        `json:"response_types,omitempty"`
+	TokenEndpointAuthMethod string          `json:"token_endpoint_auth_method,omitempty"`
+	JWKSURI                 string          `json:"jwks_uri,omitempty"`
+	JWKS                    json.RawMessage `json:"jwks,omitempty"`
+	Scope                   string          `json:"scope,omitempty"`
+	RequestURIs             []string        `json:"request_uris,omitempty"`
+}
+
+// Registration is what the registration endpoints return, RFC7591 3.2.1.
+type Registration struct {
+	Metadata
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   int64  `json:"client_secret_expires_at"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri,omitempty"` // Set by the caller, it knows the host
+}
+
+// IssueInitialAccessToken creates a token that allows registering clients
+// until it expires. The token is only returned here.
+func IssueInitialAccessToken(description string, ttl time.Duration, actor uint) (string, *models.OAuthInitialAccessToken, error) {
+	token, err := gonanoid.New(48)
+	if err != nil {
+		return "", nil, err
+	}
+
+	initial := models.OAuthInitialAccessToken{
+		TokenHash:   hashToken(token),
+		Description: description,
+		CID:         actor,
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+	if err := models.DB.Create(&initial).Error; err != nil {
+		return "", nil, err
+	}
+
+	return token, &initial, nil
+}
+
+func ListInitialAccessTokens() ([]models.OAuthInitialAccessToken, error) {
+	ret := []models.OAuthInitialAccessToken{}
+	err := models.DB.Order("id").Find(&ret).Error
+	return ret, err
+}
+
+func DeleteInitialAccessToken(id uint) error {
+	result := models.DB.Where("id = ?", id).Delete(&models.OAuthInitialAccessToken{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Register creates a client from metadata for the holder of an initial
+// access token.
+func Register(initialToken string, md *Metadata) (*Registration, error) {
+	initial := models.OAuthInitialAccessToken{}
+	if initialToken == "" || models.DB.Where("token_hash = ? AND expires_at > ?", hashToken(initialToken), time.Now()).First(&initial).Error != nil {
+		return nil, ErrInvalidToken
+	}
+
+	in, err := fromMetadata(md, &models.OAuthClientSettings{})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := Create(in, initial.CID)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := gonanoid.New(48)
+	if err != nil {
+		return nil, err
+	}
+	if err := models.DB.Create(&models.OAuthClientRegistration{
+		ClientID:             client.ID,
+		TokenHash:            hashToken(token),
+		InitialAccessTokenID: initial.ID,
+		CID:                  initial.CID,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	ret := toRegistration(client)
+	ret.RegistrationAccessToken = token
+	return ret, nil
+}
+
+// FindRegistration returns the dynamically registered client clientID if
+// token is its registration access token.
+func FindRegistration(clientID, token string) (*Client, *models.OAuthClientRegistration, error) {
+	if token == "" {
+		return nil, nil, ErrInvalidToken
+	}
+
+	row := dbTypes.OAuthClient{}
+	if err := models.DB.Where("client_id = ?", clientID).First(&row).Error; err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+
+	registration := models.OAuthClientRegistration{}
+	if err := models.DB.Where("client_id = ? AND token_hash = ?", row.ID, hashToken(token)).First(&registration).Error; err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+
+	client, err := fromRow(models.DB, &row)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, &registration, nil
+}
+
+// GetRegistration returns the client's current metadata, RFC7592 2.1.
+func GetRegistration(clientID, token string) (*Registration, error) {
+	client, _, err := FindRegistration(clientID, token)
+	if err != nil {
+		return nil, err
+	}
+	return toRegistration(client), nil
+}
+
+// UpdateRegistration replaces the client's metadata, RFC7592 2.2. Settings
+// that aren't client metadata, like claim mappings, are kept.
+func UpdateRegistration(clientID, token string, md *Metadata) (*Registration, error) {
+	client, registration, err := FindRegistration(clientID, token)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := fromMetadata(md, client.Settings)
+	if err != nil {
+		return nil, err
+	}
+	in.TTL = client.TTL
+
+	if client, err = Update(client.ID, in, registration.CID); err != nil {
+		return nil, err
+	}
+	return toRegistration(client), nil
+}
+
+// DeleteRegistration deletes the client, RFC7592 2.3.
+func DeleteRegistration(clientID, token string) error {
+	client, registration, err := FindRegistration(clientID, token)
+	if err != nil {
+		return err
+	}
+	return Delete(client.ID, registration.CID)
+}
+
+// fromMetadata applies md on top of settings, RFC7591 2 defaults included.
+func fromMetadata(md *Metadata, settings *models.OAuthClientSettings) (*Client, error) {
+	// Tokens are addressed to the name, so it has to tell clients apart
+	name := strings.TrimSpace(md.ClientName)
+	if name == "" {
+		return nil, fmt.Errorf("%w: client_name is required", ErrInvalidClientMetadata)
+	}
+	for _, responseType := range md.ResponseTypes {
+		if responseType != "code" {
+			return nil, fmt.Errorf("%w: unsupported response type %q", ErrInvalidClientMetadata, responseType)
+		}
+	}
+	if len(md.JWKS) > 0 && md.JWKSURI != "" {
+		return nil, fmt.Errorf("%w: jwks and jwks_uri are mutually exclusive", ErrInvalidClientMetadata)
+	}
+	if md.JWKSURI != "" {
+		if err := validateRegisteredFetchURI(md.JWKSURI); err != nil {
+			return nil, fmt.Errorf("%w: jwks_uri: %s", ErrInvalidClientMetadata, err.Error())
+		}
+	}
+	for _, uri := range md.RequestURIs {
+		if err := validateRegisteredFetchURI(uri); err != nil {
+			return nil, fmt.Errorf("%w: request_uris: %s", ErrInvalidClientMetadata, err.Error())
+		}
+	}
+	if md.TokenEndpointAuthMethod == models.AuthMethodPrivateKeyJWT && len(md.JWKS) == 0 && md.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: private_key_jwt requires jwks or jwks_uri", ErrInvalidClientMetadata)
+	}
+	if md.TokenEndpointAuthMethod == models.AuthMethodNone && contains(md.GrantTypes, "client_credentials") {
+		return nil, fmt.Errorf("%w: public clients can't use the client_credentials grant", ErrInvalidClientMetadata)
+	}
+
+	grantTypes := md.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = []string{"authorization_code"}
+	}
+	if contains(grantTypes, "authorization_code") && len(md.RedirectURIs) == 0 {
+		return nil, fmt.Errorf("%w: redirect_uris is required for the authorization_code grant", ErrInvalidRedirectURI)
+	}
+	authMethod := md.TokenEndpointAuthMethod
+	if authMethod == "" {
+		authMethod = models.AuthMethodClientSecretBasic
+	}
+
+	settings.GrantTypes = datatypes.JSONMap(grantTypes)
+	settings.TokenEndpointAuthMethod = authMethod
+	settings.ClientType = "" // Follows the auth method, none makes it public
+	settings.JWKSURI = md.JWKSURI
+	settings.JWKS = string(md.JWKS)
+	// Nobody vetted a registered client, it doesn't get every scope by default
+	scope := strings.Fields(md.Scope)
+	if len(scope) == 0 {
+		scope = []string{"openid"}
+	}
+	settings.AllowedScopes = datatypes.JSONMap(scope)
+	settings.RequestURIs = datatypes.JSONMap(md.RequestURIs)
+
+	return &Client{
+		Name:         name,
+		RedirectURIs: md.RedirectURIs,
+		Settings:     settings,
+	}, nil
+}
+
+// validateRegisteredFetchURI is ValidateFetchURI for self registered clients,
+// which also may not point us at internal addresses.
+func validateRegisteredFetchURI(uri string) error {
+	if err := ValidateFetchURI(uri); err != nil {
+		return err
+	}
+	if u, _ := url.Parse(uri); isInternal(u.Hostname()) {
+		return fmt.Errorf("%w: %q is an internal address", ErrInvalidFetchURI, uri)
+	}
+	return nil
+}
+
+func toRegistration(client *Client) *Registration {
+	ret := &Registration{
+		Metadata: Metadata{
+			ClientName:   client.Name,
+			RedirectURIs: client.RedirectURIs,
+		},
+		ClientID:         client.ClientID,
+		ClientSecret:     client.ClientSecret,
+		ClientIDIssuedAt: client.CreatedAt.Unix(),
+	}
+	if client.ClientSecretExpiresAt != nil {
+		ret.ClientSecretExpiresAt = client.ClientSecretExpiresAt.Unix()
+	}
+
+	if settings := client.Settings; settings != nil {
+		ret.GrantTypes = settings.GrantTypes
+		ret.TokenEndpointAuthMethod = settings.TokenEndpointAuthMethod
+		ret.JWKSURI = settings.JWKSURI
+		if settings.JWKS != "" {
+			ret.JWKS = json.RawMessage(settings.JWKS)
+		}
+		ret.Scope = strings.Join(settings.AllowedScopes, " ")
+		ret.RequestURIs = settings.RequestURIs
+		if contains(settings.GrantTypes, "authorization_code") {
+			ret.ResponseTypes = []string{"code"}
+		}
+
+		// The secret is useless to a client that authenticates with its keys
+		// or not at all
+		if settings.TokenEndpointAuthMethod == models.AuthMethodPrivateKeyJWT || settings.IsPublic() {
+			ret.ClientSecret = ""
+		}
+	}
+
+	return ret
+}
+
+// IsInvalidMetadata reports whether err means the metadata failed validation.
+func IsInvalidMetadata(err error) bool {
+	return errors.Is(err, ErrInvalidClientMetadata) || IsInvalid(err)
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
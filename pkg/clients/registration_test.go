@@ -0,0 +1,99 @@
+package clients
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/adh-partnership/sso/database/models"
+)
+
+func TestFromMetadata(t *testing.T) {
+	tests := []struct {
+		name       string
+		md         Metadata
+		wantErr    error
+		wantScopes []string
+		wantGrants []string
+		wantMethod string
+	}{
+		{
+			name:       "defaults",
+			md:         Metadata{ClientName: "app", RedirectURIs: []string{"https://app.example.com/callback"}},
+			wantScopes: []string{"openid"},
+			wantGrants: []string{"authorization_code"},
+			wantMethod: models.AuthMethodClientSecretBasic,
+		},
+		{
+			name:       "requested scopes",
+			md:         Metadata{ClientName: "app", GrantTypes: []string{"client_credentials"}, Scope: "openid email"},
+			wantScopes: []string{"openid", "email"},
+			wantGrants: []string{"client_credentials"},
+			wantMethod: models.AuthMethodClientSecretBasic,
+		},
+		{
+			name:    "without a name",
+			md:      Metadata{ClientName: " ", RedirectURIs: []string{"https://app.example.com/callback"}},
+			wantErr: ErrInvalidClientMetadata,
+		},
+		{
+			name:    "authorization code without redirect uris",
+			md:      Metadata{ClientName: "app"},
+			wantErr: ErrInvalidRedirectURI,
+		},
+		{
+			name:    "implicit flow",
+			md:      Metadata{ClientName: "app", RedirectURIs: []string{"https://app.example.com/callback"}, ResponseTypes: []string{"token"}},
+			wantErr: ErrInvalidClientMetadata,
+		},
+		{
+			name:    "jwks and jwks_uri",
+			md:      Metadata{ClientName: "app", GrantTypes: []string{"client_credentials"}, JWKS: json.RawMessage(`{"keys":[]}`), JWKSURI: "https://app.example.com/jwks.json"},
+			wantErr: ErrInvalidClientMetadata,
+		},
+		{
+			name:    "private_key_jwt without keys",
+			md:      Metadata{ClientName: "app", GrantTypes: []string{"client_credentials"}, TokenEndpointAuthMethod: models.AuthMethodPrivateKeyJWT},
+			wantErr: ErrInvalidClientMetadata,
+		},
+		{
+			name:    "public client credentials",
+			md:      Metadata{ClientName: "app", GrantTypes: []string{"client_credentials"}, TokenEndpointAuthMethod: models.AuthMethodNone},
+			wantErr: ErrInvalidClientMetadata,
+		},
+		{
+			name:    "bare request uri",
+			md:      Metadata{ClientName: "app", GrantTypes: []string{"client_credentials"}, RequestURIs: []string{"https://"}},
+			wantErr: ErrInvalidClientMetadata,
+		},
+		{
+			name:    "internal jwks_uri",
+			md:      Metadata{ClientName: "app", GrantTypes: []string{"client_credentials"}, JWKSURI: "https://10.0.0.1/jwks.json"},
+			wantErr: ErrInvalidClientMetadata,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := fromMetadata(&tt.md, &models.OAuthClientSettings{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+
+			settings := client.Settings
+			if fmt.Sprint(settings.AllowedScopes) != fmt.Sprint(tt.wantScopes) {
+				t.Errorf("expected scopes %v, got %v", tt.wantScopes, settings.AllowedScopes)
+			}
+			if fmt.Sprint(settings.GrantTypes) != fmt.Sprint(tt.wantGrants) {
+				t.Errorf("expected grant types %v, got %v", tt.wantGrants, settings.GrantTypes)
+			}
+			if settings.TokenEndpointAuthMethod != tt.wantMethod {
+				t.Errorf("expected %s, got %s", tt.wantMethod, settings.TokenEndpointAuthMethod)
+			}
+		})
+	}
+}
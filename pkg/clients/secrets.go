@@ -0,0 +1,195 @@
+package clients
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/models"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"hawton.dev/log4g"
+)
+
+// Secrets are stored as bcrypt hashes. Plaintext secrets from before secrets
+// were hashed, and unsalted SHA-256 hashes, are still accepted and re-hashed
+// with bcrypt on their next use. The exception are clients using
+// client_secret_jwt: their secret is the HMAC key the assertion is verified
+// with, so it has to be kept as is. Switching a client to client_secret_jwt
+// issues a new secret, and switching it away re-hashes the secret on its next
+// use.
+
+const sha256Prefix = "sha256:"
+
+// secretCost is the bcrypt cost new secrets are hashed with
+var secretCost = bcrypt.DefaultCost
+
+var log = log4g.Category("clients")
+
+// VerifySecret checks secret against the client's current secret and, during
+// a rotation, the previous one. Plaintext secrets and SHA-256 hashes are
+// re-hashed with bcrypt the first time they are used.
+func VerifySecret(client *dbTypes.OAuthClient, secret string) (bool, error) {
+	settings, err := models.GetClientSettings(client.ID)
+	if err != nil {
+		return false, err
+	}
+	rotation, err := getRotation(models.DB, client.ID)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if rotation.ExpiresAt == nil || now.Before(*rotation.ExpiresAt) {
+		if matches(client.ClientSecret, secret) {
+			if !isBcrypt(client.ClientSecret) && !keepsPlaintext(settings) {
+				migrate(client, secret)
+			}
+			return true, nil
+		}
+	}
+
+	if rotation.Previous != "" && rotation.PreviousExpiresAt != nil && now.Before(*rotation.PreviousExpiresAt) {
+		return matches(rotation.Previous, secret), nil
+	}
+
+	return false, nil
+}
+
+// HMACSecrets returns the secrets a client_secret_jwt assertion may be signed
+// with, the current one first.
+func HMACSecrets(client *dbTypes.OAuthClient) ([]string, error) {
+	rotation, err := getRotation(models.DB, client.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var ret []string
+	if !isHashed(client.ClientSecret) && (rotation.ExpiresAt == nil || now.Before(*rotation.ExpiresAt)) {
+		ret = append(ret, client.ClientSecret)
+	}
+	if rotation.Previous != "" && !isHashed(rotation.Previous) && rotation.PreviousExpiresAt != nil && now.Before(*rotation.PreviousExpiresAt) {
+		ret = append(ret, rotation.Previous)
+	}
+	return ret, nil
+}
+
+// storedSecret is what is kept for a new secret of a client with settings.
+func storedSecret(settings *models.OAuthClientSettings, secret string) (string, error) {
+	if keepsPlaintext(settings) {
+		return secret, nil
+	}
+
+	return hashSecret(secret)
+}
+
+// rotateSecret makes stored the client's current secret. The old secret stays
+// valid for previousTTL, the new one for ttl, zero meaning forever.
+func rotateSecret(tx *gorm.DB, row *dbTypes.OAuthClient, stored string, previousTTL, ttl time.Duration) error {
+	rotation, err := getRotation(tx, row.ID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	rotation.Previous = ""
+	rotation.PreviousExpiresAt = nil
+	if previousTTL > 0 {
+		previousExpiresAt := now.Add(previousTTL)
+		// An expiring secret can't be kept around longer than it had left
+		if rotation.ExpiresAt != nil && rotation.ExpiresAt.Before(previousExpiresAt) {
+			previousExpiresAt = *rotation.ExpiresAt
+		}
+		rotation.Previous = row.ClientSecret
+		rotation.PreviousExpiresAt = &previousExpiresAt
+
+		// Don't keep a secret from before hashing around in plaintext
+		if isHashed(stored) && !isHashed(rotation.Previous) {
+			if rotation.Previous, err = hashSecret(rotation.Previous); err != nil {
+				return err
+			}
+		}
+	}
+
+	rotation.ExpiresAt = nil
+	if ttl > 0 {
+		expiresAt := now.Add(ttl)
+		rotation.ExpiresAt = &expiresAt
+	}
+
+	if err := tx.Model(&dbTypes.OAuthClient{}).Where("id = ?", row.ID).Update("client_secret", stored).Error; err != nil {
+		return err
+	}
+	return tx.Save(rotation).Error
+}
+
+func getRotation(tx *gorm.DB, id uint) (*models.OAuthClientSecret, error) {
+	rotation := models.OAuthClientSecret{}
+	if err := tx.Where("client_id = ?", id).First(&rotation).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &models.OAuthClientSecret{ClientID: id}, nil
+		}
+		return nil, err
+	}
+	return &rotation, nil
+}
+
+// migrate replaces the client's plaintext or SHA-256 hashed secret with its
+// bcrypt hash. Failing only means it is tried again on the next use.
+func migrate(client *dbTypes.OAuthClient, secret string) {
+	hash, err := hashSecret(secret)
+	if err != nil {
+		log.Error("Error hashing the secret of client %s: %s", client.ClientID, err.Error())
+		return
+	}
+
+	// Only if nobody rotated it in the meantime
+	if err := models.DB.Model(&dbTypes.OAuthClient{}).Where("id = ? AND client_secret = ?", client.ID, client.ClientSecret).Update("client_secret", hash).Error; err != nil {
+		log.Error("Error storing the hashed secret of client %s: %s", client.ClientID, err.Error())
+		return
+	}
+	client.ClientSecret = hash
+	log.Info("Re-hashed the secret of client %s", client.ClientID)
+}
+
+func hashSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), secretCost)
+	return string(hash), err
+}
+
+// sha256Secret is how secrets were hashed before bcrypt, only to check them.
+func sha256Secret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return sha256Prefix + hex.EncodeToString(hash[:])
+}
+
+func matches(stored, secret string) bool {
+	if stored == "" || secret == "" {
+		return false
+	}
+	if strings.HasPrefix(stored, sha256Prefix) {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(sha256Secret(secret))) == 1
+	}
+	if isBcrypt(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(secret)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(secret)) == 1
+}
+
+func isHashed(stored string) bool {
+	return strings.HasPrefix(stored, sha256Prefix) || isBcrypt(stored)
+}
+
+func isBcrypt(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
+func keepsPlaintext(settings *models.OAuthClientSettings) bool {
+	return settings.TokenEndpointAuthMethod == models.AuthMethodClientSecretJWT
+}
@@ -0,0 +1,100 @@
+package clients
+
+import (
+	"testing"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/database/models/modelstest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMatches(t *testing.T) {
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hashing: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		stored string
+		secret string
+		want   bool
+	}{
+		{name: "sha256", stored: sha256Secret("secret"), secret: "secret", want: true},
+		{name: "sha256 mismatch", stored: sha256Secret("secret"), secret: "other"},
+		{name: "bcrypt", stored: string(bcrypted), secret: "secret", want: true},
+		{name: "bcrypt mismatch", stored: string(bcrypted), secret: "other"},
+		{name: "plaintext", stored: "secret", secret: "secret", want: true},
+		{name: "plaintext mismatch", stored: "secret", secret: "other"},
+		{name: "the hash isn't the secret", stored: sha256Secret("secret"), secret: sha256Secret("secret")},
+		{name: "no secret", stored: "", secret: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matches(tt.stored, tt.secret); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestVerifySecretRehashes(t *testing.T) {
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hashing: %s", err)
+	}
+
+	cost := secretCost
+	secretCost = bcrypt.MinCost
+	t.Cleanup(func() { secretCost = cost })
+
+	tests := []struct {
+		name     string
+		stored   string
+		settings models.OAuthClientSettings
+		want     string // Empty for a new bcrypt hash
+	}{
+		{name: "plaintext", stored: "secret"},
+		{name: "sha256", stored: sha256Secret("secret")},
+		{name: "bcrypt is kept", stored: string(bcrypted), want: string(bcrypted)},
+		{
+			name:     "client_secret_jwt keeps its plaintext",
+			stored:   "secret",
+			settings: models.OAuthClientSettings{TokenEndpointAuthMethod: models.AuthMethodClientSecretJWT},
+			want:     "secret",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modelstest.Setup(t)
+			client := dbTypes.OAuthClient{Name: "test", ClientID: "test", ClientSecret: tt.stored}
+			if err := models.DB.Create(&client).Error; err != nil {
+				t.Fatalf("creating client: %s", err)
+			}
+			tt.settings.ClientID = client.ID
+			if err := models.DB.Create(&tt.settings).Error; err != nil {
+				t.Fatalf("creating settings: %s", err)
+			}
+
+			if ok, err := VerifySecret(&client, "secret"); !ok || err != nil {
+				t.Fatalf("expected the secret to match, got %v: %v", ok, err)
+			}
+			if ok, _ := VerifySecret(&client, "other"); ok {
+				t.Fatalf("expected another secret not to match")
+			}
+
+			stored := dbTypes.OAuthClient{}
+			models.DB.Where("id = ?", client.ID).First(&stored)
+			if tt.want == "" {
+				if !isBcrypt(stored.ClientSecret) || !matches(stored.ClientSecret, "secret") {
+					t.Errorf("expected a bcrypt hash of the secret to be stored, got %q", stored.ClientSecret)
+				}
+			} else if stored.ClientSecret != tt.want {
+				t.Errorf("expected %q to be stored, got %q", tt.want, stored.ClientSecret)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package idp
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// IdentityProvider is an upstream OAuth2 server users log in through.
+type IdentityProvider interface {
+	// AuthURL is where the user is sent to log in, they are sent back to
+	// redirectURI with a code afterwards.
+	AuthURL(redirectURI, state string) string
+	// Exchange trades the code from the callback for an upstream access token.
+	Exchange(ctx context.Context, code, redirectURI string) (string, error)
+	// User fetches the user the upstream access token belongs to.
+	User(ctx context.Context, accessToken string) (*User, error)
+}
+
+// User is the upstream user normalized to what we need to create or find our
+// own user record.
+type User struct {
+	CID         uint
+	FirstName   string
+	LastName    string
+	Email       string
+	RatingID    int
+	RatingShort string
+	RatingLong  string
+}
+
+type Config struct {
+	BaseURL       string
+	AuthorizePath string
+	TokenPath     string
+	UserInfoPath  string
+	ClientID      string
+	ClientSecret  string
+	Scopes        []string
+}
+
+type Factory func(Config) IdentityProvider
+
+var providers = map[string]Factory{}
+
+// Current is the provider used by the authorize and callback controllers.
+var Current IdentityProvider
+
+func Register(name string, factory Factory) {
+	providers[name] = factory
+}
+
+func New(name string, config Config) (IdentityProvider, error) {
+	factory, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown identity provider %s", name)
+	}
+	return factory(config), nil
+}
+
+func ConfigFromEnv() Config {
+	return Config{
+		BaseURL:       os.Getenv("VATSIM_BASE_URL"),
+		AuthorizePath: os.Getenv("VATSIM_AUTHORIZE_PATH"),
+		TokenPath:     os.Getenv("VATSIM_TOKEN_PATH"),
+		UserInfoPath:  os.Getenv("VATSIM_USER_INFO_PATH"),
+		ClientID:      os.Getenv("VATSIM_OAUTH_CLIENT_ID"),
+		ClientSecret:  os.Getenv("VATSIM_OAUTH_CLIENT_SECRET"),
+		Scopes:        strings.Fields(os.Getenv("VATSIM_OAUTH_SCOPES")),
+	}
+}
+
+func authURL(config Config, redirectURI, state string) string {
+	u := fmt.Sprintf("%s%s?client_id=%s&redirect_uri=%s&scope=%s&response_type=code",
+		config.BaseURL,
+		config.AuthorizePath,
+		url.QueryEscape(config.ClientID),
+		url.QueryEscape(redirectURI),
+		url.QueryEscape(strings.Join(config.Scopes, " ")),
+	)
+	if state != "" {
+		u += "&state=" + url.QueryEscape(state)
+	}
+	return u
+}
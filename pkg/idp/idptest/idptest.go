@@ -0,0 +1,200 @@
+// Package idptest provides an in-process stand-in for VATSIM Connect so the
+// whole login flow can be exercised without the network.
+package idptest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/adh-partnership/sso/pkg/idp"
+)
+
+const (
+	AuthorizePath = "/oauth/authorize"
+	TokenPath     = "/oauth/token"
+	UserInfoPath  = "/api/user"
+
+	ClientID     = "1234"
+	ClientSecret = "idptest-secret"
+)
+
+// Server answers with the VATSIM Connect response shapes. Authorization is
+// granted immediately as whichever user was last selected with LoginAs.
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	users   map[uint]idp.User
+	current uint
+	codes   map[string]uint
+	tokens  map[string]uint
+}
+
+func NewServer(users ...idp.User) *Server {
+	s := &Server{
+		users:  map[uint]idp.User{},
+		codes:  map[string]uint{},
+		tokens: map[string]uint{},
+	}
+	for _, user := range users {
+		s.AddUser(user)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(AuthorizePath, s.authorize)
+	mux.HandleFunc(TokenPath, s.token)
+	mux.HandleFunc(UserInfoPath, s.userInfo)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// AddUser makes a user available upstream, the first user added is logged in
+// by default.
+func (s *Server) AddUser(user idp.User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[user.CID] = user
+	if s.current == 0 {
+		s.current = user.CID
+	}
+}
+
+// LoginAs selects the user the next authorization will log in.
+func (s *Server) LoginAs(cid uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.current = cid
+}
+
+// Config is the provider configuration pointing at this server.
+func (s *Server) Config() idp.Config {
+	return idp.Config{
+		BaseURL:       s.URL,
+		AuthorizePath: AuthorizePath,
+		TokenPath:     TokenPath,
+		UserInfoPath:  UserInfoPath,
+		ClientID:      ClientID,
+		ClientSecret:  ClientSecret,
+		Scopes:        []string{"full_name", "email", "vatsim_details"},
+	}
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("redirect_uri") == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("client_id") != ClientID || q.Get("response_type") != "code" {
+		http.Error(w, "invalid client_id or response_type", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	cid := s.current
+	code := randomString()
+	if _, ok := s.users[cid]; ok {
+		s.codes[code] = cid
+	}
+	s.mu.Unlock()
+
+	ret := redirectURI.Query()
+	if cid == 0 {
+		ret.Set("error", "access_denied")
+	} else {
+		ret.Set("code", code)
+	}
+	if state := q.Get("state"); state != "" {
+		ret.Set("state", state)
+	}
+	redirectURI.RawQuery = ret.Encode()
+
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	req := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	if fmt.Sprint(req["client_id"]) != ClientID || fmt.Sprint(req["client_secret"]) != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code := fmt.Sprint(req["code"])
+	cid, ok := s.codes[code]
+	if req["grant_type"] != "authorization_code" || !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	delete(s.codes, code)
+
+	token := randomString()
+	s.tokens[token] = cid
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	})
+}
+
+func (s *Server) userInfo(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	s.mu.Lock()
+	user, ok := s.users[s.tokens[token]]
+	s.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "Unauthenticated."})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"cid": fmt.Sprint(user.CID),
+			"personal": map[string]interface{}{
+				"name_first": user.FirstName,
+				"name_last":  user.LastName,
+				"name_full":  fmt.Sprintf("%s %s", user.FirstName, user.LastName),
+				"email":      user.Email,
+			},
+			"vatsim": map[string]interface{}{
+				"rating": map[string]interface{}{
+					"id":    user.RatingID,
+					"short": user.RatingShort,
+					"long":  user.RatingLong,
+				},
+			},
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,80 @@
+package idp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+type accessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// exchange posts the token request as JSON, both VATSIM Connect and our own
+// SSO accept it that way.
+func exchange(ctx context.Context, config Config, data map[string]interface{}) (string, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, config.BaseURL+config.TokenPath, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+
+	body, err := do(request)
+	if err != nil {
+		return "", err
+	}
+
+	accessToken := &accessTokenResponse{}
+	if err = json.Unmarshal(body, accessToken); err != nil {
+		return "", err
+	}
+	if accessToken.AccessToken == "" {
+		return "", fmt.Errorf("no access token received")
+	}
+
+	return accessToken.AccessToken, nil
+}
+
+func userInfo(ctx context.Context, config Config, accessToken string, v interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, config.BaseURL+config.UserInfoPath, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	request.Header.Set("Accept", "application/json")
+
+	body, err := do(request)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+func do(request *http.Request) ([]byte, error) {
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode > 399 {
+		return nil, fmt.Errorf("error %d received from %s: %s", response.StatusCode, request.URL.Host, string(body))
+	}
+
+	return body, nil
+}
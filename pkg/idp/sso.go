@@ -0,0 +1,61 @@
+package idp
+
+import (
+	"context"
+	"fmt"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+)
+
+func init() {
+	Register("sso", NewSSO)
+}
+
+// SSO chains to another instance of this SSO, or anything else answering
+// with the API's user shape, instead of talking to VATSIM directly.
+type SSO struct {
+	config Config
+}
+
+type ssoResponse struct {
+	User *dbTypes.User `json:"user"`
+}
+
+func NewSSO(config Config) IdentityProvider {
+	return &SSO{config: config}
+}
+
+func (s *SSO) AuthURL(redirectURI, state string) string {
+	return authURL(s.config, redirectURI, state)
+}
+
+func (s *SSO) Exchange(ctx context.Context, code, redirectURI string) (string, error) {
+	return exchange(ctx, s.config, map[string]interface{}{
+		"grant_type":    "authorization_code",
+		"code":          code,
+		"redirect_uri":  redirectURI,
+		"client_id":     s.config.ClientID,
+		"client_secret": s.config.ClientSecret,
+		"scopes":        s.config.Scopes,
+	})
+}
+
+func (s *SSO) User(ctx context.Context, accessToken string) (*User, error) {
+	resp := &ssoResponse{}
+	if err := userInfo(ctx, s.config, accessToken, resp); err != nil {
+		return nil, err
+	}
+	if resp.User == nil {
+		return nil, fmt.Errorf("no user received")
+	}
+
+	return &User{
+		CID:         resp.User.CID,
+		FirstName:   resp.User.FirstName,
+		LastName:    resp.User.LastName,
+		Email:       resp.User.Email,
+		RatingID:    resp.User.Rating.ID,
+		RatingShort: resp.User.Rating.Short,
+		RatingLong:  resp.User.Rating.Long,
+	}, nil
+}
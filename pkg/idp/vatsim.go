@@ -0,0 +1,78 @@
+package idp
+
+import (
+	"context"
+	"strconv"
+)
+
+func init() {
+	Register("vatsim", NewVatsim)
+}
+
+// Vatsim logs users in through VATSIM Connect.
+type Vatsim struct {
+	config Config
+}
+
+type vatsimResponse struct {
+	Data struct {
+		CID      string `json:"cid"`
+		Personal struct {
+			FirstName string `json:"name_first"`
+			LastName  string `json:"name_last"`
+			FullName  string `json:"name_full"`
+			Email     string `json:"email"`
+		} `json:"personal"`
+		Vatsim struct {
+			Rating struct {
+				ID    int    `json:"id"`
+				Long  string `json:"long"`
+				Short string `json:"short"`
+			} `json:"rating"`
+		} `json:"vatsim"`
+	} `json:"data"`
+}
+
+func NewVatsim(config Config) IdentityProvider {
+	return &Vatsim{config: config}
+}
+
+func (v *Vatsim) AuthURL(redirectURI, state string) string {
+	return authURL(v.config, redirectURI, state)
+}
+
+func (v *Vatsim) Exchange(ctx context.Context, code, redirectURI string) (string, error) {
+	// VATSIM wants the client id as an int, the RFC says string
+	clientID, _ := strconv.Atoi(v.config.ClientID)
+
+	return exchange(ctx, v.config, map[string]interface{}{
+		"grant_type":    "authorization_code",
+		"code":          code,
+		"redirect_uri":  redirectURI,
+		"client_id":     clientID,
+		"client_secret": v.config.ClientSecret,
+		"scopes":        v.config.Scopes,
+	})
+}
+
+func (v *Vatsim) User(ctx context.Context, accessToken string) (*User, error) {
+	resp := &vatsimResponse{}
+	if err := userInfo(ctx, v.config, accessToken, resp); err != nil {
+		return nil, err
+	}
+
+	cid, err := strconv.ParseUint(resp.Data.CID, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &User{
+		CID:         uint(cid),
+		FirstName:   resp.Data.Personal.FirstName,
+		LastName:    resp.Data.Personal.LastName,
+		Email:       resp.Data.Personal.Email,
+		RatingID:    resp.Data.Vatsim.Rating.ID,
+		RatingShort: resp.Data.Vatsim.Rating.Short,
+		RatingLong:  resp.Data.Vatsim.Rating.Long,
+	}, nil
+}
@@ -0,0 +1,229 @@
+package keys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// Dir is a directory of private keys that sign alongside the keys in the
+// database. Files ending in .json hold a JWK or JWKS, files ending in .pem
+// hold PEM encoded keys. Keys are picked up in file name order, so when
+// several have the same alg the last one signs.
+//
+// A key added while the SSO is running is only published for
+// DirPublishDelay before it signs, so relying parties with a cached JWKS
+// know it by then. Keys that are there on start sign right away, as do keys
+// for an algorithm nothing else signs. Keys added while the SSO is down have
+// to be published ahead of time, with keys export-public or by adding them
+// to a running replica first.
+var Dir string
+
+// DirPublishDelay is how long a new key from Dir is published before it
+// signs, twice the default JWKS max-age.
+var DirPublishDelay = 10 * time.Minute
+
+var ErrNotPrivateKey = errors.New("not a private key")
+
+var (
+	seenMu sync.Mutex
+	// When each key in Dir was first loaded, nil before the first load
+	seen map[string]time.Time
+)
+
+// LoadDir parses every key file in dir. A file that can't be parsed fails
+// the whole load so a half written key never replaces a working set.
+func LoadDir(dir string) (jwk.Set, error) {
+	files, err := keyFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	set := jwk.NewSet()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var parsed jwk.Set
+		if strings.HasSuffix(file, ".pem") {
+			parsed, err = jwk.Parse(data, jwk.WithPEM(true))
+		} else {
+			parsed, err = jwk.Parse(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", file, err)
+		}
+
+		for i := 0; i < parsed.Len(); i++ {
+			key, _ := parsed.Key(i)
+			if err := prepareFileKey(key); err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			set.AddKey(key)
+		}
+	}
+
+	return set, nil
+}
+
+// prepareFileKey fills in what PEM files (and lazily written JWKs) leave out.
+// Public and symmetric keys are rejected, they can't sign tokens relying
+// parties can verify.
+func prepareFileKey(key jwk.Key) error {
+	switch key.(type) {
+	case jwk.RSAPrivateKey, jwk.ECDSAPrivateKey, jwk.OKPPrivateKey:
+	default:
+		return ErrNotPrivateKey
+	}
+	if key.Algorithm().String() == "" {
+		alg, err := defaultAlgorithm(key)
+		if err != nil {
+			return err
+		}
+		key.Set(jwk.AlgorithmKey, alg)
+	}
+	if key.KeyID() == "" {
+		if err := jwk.AssignKeyID(key); err != nil {
+			return err
+		}
+	}
+	if key.KeyUsage() == "" {
+		key.Set(jwk.KeyUsageKey, jwk.ForSignature)
+	}
+	return nil
+}
+
+func defaultAlgorithm(key jwk.Key) (jwa.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case jwk.RSAPrivateKey:
+		return jwa.RS256, nil
+	case jwk.ECDSAPrivateKey:
+		switch k.Crv() {
+		case jwa.P256:
+			return jwa.ES256, nil
+		case jwa.P384:
+			return jwa.ES384, nil
+		case jwa.P521:
+			return jwa.ES512, nil
+		}
+	case jwk.OKPPrivateKey:
+		if k.Crv() == jwa.Ed25519 {
+			return jwa.EdDSA, nil
+		}
+	}
+	return "", ErrUnsupportedAlgorithm
+}
+
+// stage splits keys from Dir into the ones that sign and the ones that are
+// only published until DirPublishDelay has passed since they were first
+// loaded.
+func stage(set jwk.Set, now time.Time) (jwk.Set, jwk.Set) {
+	seenMu.Lock()
+	defer seenMu.Unlock()
+
+	first := seen == nil
+	current := map[string]time.Time{}
+	ready, staged := jwk.NewSet(), jwk.NewSet()
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Key(i)
+		at, ok := seen[key.KeyID()]
+		if !ok {
+			at = now
+			if first {
+				at = now.Add(-DirPublishDelay)
+			} else {
+				log.Info("Publishing %s key %s from %s, it signs in %s", key.Algorithm(), key.KeyID(), Dir, DirPublishDelay)
+			}
+		}
+		current[key.KeyID()] = at
+
+		if now.Sub(at) >= DirPublishDelay {
+			ready.AddKey(key)
+		} else {
+			staged.AddKey(key)
+		}
+	}
+	seen = current
+
+	return ready, staged
+}
+
+func keyFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".pem") {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// dirFingerprint changes whenever a key file is added, removed or modified.
+func dirFingerprint(dir string) (string, error) {
+	files, err := keyFiles(dir)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s|%d|%d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Watch reloads the keys whenever the files in Dir change. Kubernetes swaps
+// mounted secrets through a symlink without a usable inotify event, so the
+// directory is polled rather than watched.
+func Watch(interval time.Duration) {
+	if Dir == "" {
+		return
+	}
+
+	last, _ := dirFingerprint(Dir)
+	for range time.Tick(interval) {
+		current, err := dirFingerprint(Dir)
+		if err != nil {
+			log.Error("Error checking %s for key changes: %s", Dir, err.Error())
+			continue
+		}
+		if current == last {
+			continue
+		}
+
+		if err := Load(); err != nil {
+			log.Error("Error reloading keys after %s changed, keeping the current keys: %s", Dir, err.Error())
+			continue
+		}
+		last = current
+		log.Info("Reloaded keys after %s changed", Dir)
+	}
+}
@@ -0,0 +1,133 @@
+package keys
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adh-partnership/sso/pkg/tokens"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+func writeKey(t *testing.T, dir, name string, key jwk.Key) {
+	t.Helper()
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		t.Fatalf("encoding key: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+		t.Fatalf("writing key: %s", err)
+	}
+}
+
+func generate(t *testing.T, alg jwa.SignatureAlgorithm) jwk.Key {
+	t.Helper()
+
+	key, err := Generate(alg)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	return key
+}
+
+func signingKID(t *testing.T, alg jwa.SignatureAlgorithm) string {
+	t.Helper()
+
+	key, err := tokens.SigningKey(alg)
+	if err != nil {
+		t.Fatalf("finding the %s signing key: %s", alg, err)
+	}
+	return key.KeyID()
+}
+
+func TestLoadDirStagesNewKeys(t *testing.T) {
+	setupDB(t)
+	Dir = t.TempDir()
+	seen = nil
+	t.Cleanup(func() { seen = nil })
+
+	first := generate(t, jwa.ES256)
+	writeKey(t, Dir, "a.json", first)
+	if err := Load(); err != nil {
+		t.Fatalf("loading keys: %s", err)
+	}
+	if kid := signingKID(t, jwa.ES256); kid != first.KeyID() {
+		t.Fatalf("expected the key present on start to sign, got %s", kid)
+	}
+
+	second := generate(t, jwa.ES256)
+	writeKey(t, Dir, "b.json", second)
+	if err := Load(); err != nil {
+		t.Fatalf("loading keys: %s", err)
+	}
+	if kid := signingKID(t, jwa.ES256); kid != first.KeyID() {
+		t.Errorf("expected the new key to only be published, got %s signing", kid)
+	}
+	if _, ok := tokens.PublicKeys().LookupKeyID(second.KeyID()); !ok {
+		t.Errorf("expected the new key to be published")
+	}
+
+	// A new algorithm has nothing else to sign with
+	eddsa := generate(t, jwa.EdDSA)
+	writeKey(t, Dir, "c.json", eddsa)
+	if err := Load(); err != nil {
+		t.Fatalf("loading keys: %s", err)
+	}
+	if kid := signingKID(t, jwa.EdDSA); kid != eddsa.KeyID() {
+		t.Errorf("expected the only EdDSA key to sign, got %s", kid)
+	}
+
+	seenMu.Lock()
+	seen[second.KeyID()] = time.Now().Add(-DirPublishDelay)
+	seenMu.Unlock()
+	if err := Load(); err != nil {
+		t.Fatalf("loading keys: %s", err)
+	}
+	if kid := signingKID(t, jwa.ES256); kid != second.KeyID() {
+		t.Errorf("expected the new key to sign once published long enough, got %s", kid)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	private := generate(t, jwa.ES256)
+	public, err := private.PublicKey()
+	if err != nil {
+		t.Fatalf("getting the public key: %s", err)
+	}
+	symmetric, err := jwk.FromRaw([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("creating symmetric key: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		key     jwk.Key
+		wantErr error
+	}{
+		{name: "private key", key: private},
+		{name: "public key", key: public, wantErr: ErrNotPrivateKey},
+		{name: "symmetric key", key: symmetric, wantErr: ErrNotPrivateKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeKey(t, dir, "key.json", tt.key)
+			// Files that aren't keys are ignored
+			os.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0600)
+
+			set, err := LoadDir(dir)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && set.Len() != 1 {
+				t.Errorf("expected one key, got %d", set.Len())
+			}
+		})
+	}
+}
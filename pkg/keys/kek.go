@@ -0,0 +1,83 @@
+package keys
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// KEK is the AES-256 key the private keys in the database are encrypted with,
+// nil stores them in plaintext. Keys stored before a KEK was set stay
+// readable and are replaced by encrypted ones as they rotate out.
+var KEK []byte
+
+const sealedPrefix = "enc:v1:"
+
+var (
+	ErrInvalidKEK = errors.New("the key encryption key must be 32 base64 encoded bytes")
+	ErrNoKEK      = errors.New("key is encrypted but no key encryption key is set")
+)
+
+// ParseKEK decodes a base64 encoded 32 byte key encryption key.
+func ParseKEK(s string) ([]byte, error) {
+	kek, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(kek) != 32 {
+		return nil, ErrInvalidKEK
+	}
+	return kek, nil
+}
+
+// seal encrypts a private JWK with KEK, bound to its kid so rows can't be
+// swapped.
+func seal(kid string, data []byte) (string, error) {
+	if KEK == nil {
+		return string(data), nil
+	}
+
+	aead, err := newAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, data, []byte(kid))
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// unseal reverses seal, plaintext keys are returned as they are.
+func unseal(kid, stored string) ([]byte, error) {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return []byte(stored), nil
+	}
+	if KEK == nil {
+		return nil, ErrNoKEK
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedPrefix))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed key is too short")
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(kid))
+}
+
+func newAEAD() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(KEK)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,454 @@
+package keys
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/pkg/tokens"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"hawton.dev/log4g"
+)
+
+var (
+	// A key activated more recently than this is not rotated again, so every
+	// replica running the same schedule only rotates once
+	MinActiveAge = time.Hour
+)
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrMissingAlgorithm     = errors.New("key has no alg")
+	ErrKeyNotFound          = errors.New("key not found")
+	ErrLastActiveKey        = errors.New("can't retire the last active key without a pending key to replace it")
+)
+
+var log = log4g.Category("keys")
+
+// ParseAlgorithms parses a comma separated list of signing algorithms.
+func ParseAlgorithms(s string) ([]jwa.SignatureAlgorithm, error) {
+	var algs []jwa.SignatureAlgorithm
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		alg := jwa.SignatureAlgorithm(a)
+		if _, err := generateRaw(alg, true); err != nil {
+			return nil, fmt.Errorf("%w: %s", err, a)
+		}
+		algs = append(algs, alg)
+	}
+	return algs, nil
+}
+
+// Generate creates a new private key for alg, its kid is the RFC7638
+// thumbprint of the key.
+func Generate(alg jwa.SignatureAlgorithm) (jwk.Key, error) {
+	raw, err := generateRaw(alg, false)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := jwk.FromRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := jwk.AssignKeyID(key); err != nil {
+		return nil, err
+	}
+	key.Set(jwk.AlgorithmKey, alg)
+	key.Set(jwk.KeyUsageKey, jwk.ForSignature)
+
+	return key, nil
+}
+
+// generateRaw generates the raw private key for alg, dryRun only checks alg
+// is supported.
+func generateRaw(alg jwa.SignatureAlgorithm, dryRun bool) (interface{}, error) {
+	var curve elliptic.Curve
+	switch alg {
+	case jwa.RS256, jwa.RS384, jwa.RS512:
+		if dryRun {
+			return nil, nil
+		}
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case jwa.ES256:
+		curve = elliptic.P256()
+	case jwa.ES384:
+		curve = elliptic.P384()
+	case jwa.ES512:
+		curve = elliptic.P521()
+	case jwa.EdDSA:
+		if dryRun {
+			return nil, nil
+		}
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	if dryRun {
+		return nil, nil
+	}
+	return ecdsa.GenerateKey(curve, rand.Reader)
+}
+
+// Create generates a key for alg and stores it in the given state.
+func Create(tx *gorm.DB, alg jwa.SignatureAlgorithm, state string) (*models.SigningKey, error) {
+	key, err := Generate(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	return store(tx, key, state)
+}
+
+func store(tx *gorm.DB, key jwk.Key, state string) (*models.SigningKey, error) {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(key.KeyID(), data)
+	if err != nil {
+		return nil, err
+	}
+
+	sk := models.SigningKey{
+		KID:        key.KeyID(),
+		Algorithm:  key.Algorithm().String(),
+		State:      state,
+		PrivateJWK: sealed,
+	}
+	if state == models.KeyStateActive {
+		now := time.Now()
+		sk.ActivatedAt = &now
+	}
+	if err := tx.Create(&sk).Error; err != nil {
+		return nil, err
+	}
+
+	return &sk, nil
+}
+
+// Import stores the keys of a private JWKS as active keys. It does nothing
+// once the database has keys, so it is safe to call on every start.
+func Import(jwks string) (int, error) {
+	if jwks == "" {
+		return 0, nil
+	}
+
+	var count int64
+	if err := models.DB.Model(&models.SigningKey{}).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		return 0, nil
+	}
+
+	set, err := jwk.Parse([]byte(jwks))
+	if err != nil {
+		return 0, err
+	}
+
+	err = models.DB.Transaction(func(tx *gorm.DB) error {
+		for i := 0; i < set.Len(); i++ {
+			key, _ := set.Key(i)
+			if key.Algorithm().String() == "" {
+				return fmt.Errorf("%w: key %d", ErrMissingAlgorithm, i)
+			}
+			if key.KeyID() == "" {
+				if err := jwk.AssignKeyID(key); err != nil {
+					return err
+				}
+			}
+			if _, err := store(tx, key, models.KeyStateActive); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return set.Len(), nil
+}
+
+// Ensure makes sure every algorithm has an active key and a pending key to
+// rotate to.
+func Ensure(algs []jwa.SignatureAlgorithm) error {
+	for _, alg := range algs {
+		for _, state := range []string{models.KeyStateActive, models.KeyStatePending} {
+			var count int64
+			if err := models.DB.Model(&models.SigningKey{}).Where("algorithm = ? AND state = ?", alg.String(), state).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
+
+			sk, err := Create(models.DB, alg, state)
+			if err != nil {
+				return err
+			}
+			log.Info("Generated %s %s key %s", state, alg, sk.KID)
+		}
+	}
+
+	return nil
+}
+
+// Load reads the keys from the database and Dir and swaps them into
+// pkg/tokens in one go. Active keys sign, pending and retiring keys are only
+// published. Keys from Dir sign once they have been published long enough.
+func Load() error {
+	signing, published, err := load()
+	if err != nil {
+		return err
+	}
+
+	if Dir != "" {
+		files, err := LoadDir(Dir)
+		if err != nil {
+			return err
+		}
+		ready, staged := stage(files, time.Now())
+		for i := 0; i < ready.Len(); i++ {
+			key, _ := ready.Key(i)
+			signing.AddKey(key)
+			published.AddKey(key)
+		}
+		for i := 0; i < staged.Len(); i++ {
+			key, _ := staged.Key(i)
+			published.AddKey(key)
+		}
+		// A staged key is better than no key at all
+		for i := 0; i < staged.Len(); i++ {
+			key, _ := staged.Key(i)
+			if !hasAlgorithm(signing, key.Algorithm()) {
+				signing.AddKey(key)
+			}
+		}
+	}
+
+	return tokens.SetKeys(signing, published)
+}
+
+func hasAlgorithm(set jwk.Set, alg jwa.KeyAlgorithm) bool {
+	for i := 0; i < set.Len(); i++ {
+		if key, _ := set.Key(i); key.Algorithm() == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// PublicSet returns the public keys of every published key in the database.
+func PublicSet() (jwk.Set, error) {
+	_, published, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	return jwk.PublicSetOf(published)
+}
+
+func load() (jwk.Set, jwk.Set, error) {
+	var rows []models.SigningKey
+	// Ordered by activation so tokens.SigningKey picks the newest active key
+	if err := models.DB.Where("state IN ?", []string{models.KeyStatePending, models.KeyStateActive, models.KeyStateRetiring}).Order("activated_at, id").Find(&rows).Error; err != nil {
+		return nil, nil, err
+	}
+
+	signing := jwk.NewSet()
+	published := jwk.NewSet()
+	for _, row := range rows {
+		data, err := unseal(row.KID, row.PrivateJWK)
+		if err != nil {
+			log.Error("Error decrypting key %s, skipping: %s", row.KID, err.Error())
+			continue
+		}
+		key, err := jwk.ParseKey(data)
+		if err != nil {
+			log.Error("Error parsing key %s, skipping: %s", row.KID, err.Error())
+			continue
+		}
+		published.AddKey(key)
+		if row.State == models.KeyStateActive {
+			signing.AddKey(key)
+		}
+	}
+
+	return signing, published, nil
+}
+
+// List returns every key in the database, retired ones included.
+func List() ([]models.SigningKey, error) {
+	var rows []models.SigningKey
+	if err := models.DB.Order("algorithm, id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Retire immediately retires a key, tokens it signed stop validating once
+// every replica has reloaded its keys. Retiring the last active key of an
+// algorithm activates its pending key and publishes a new pending one, so
+// there is always a key to sign with.
+func Retire(kid string) error {
+	return models.DB.Transaction(func(tx *gorm.DB) error {
+		key := models.SigningKey{}
+		if err := tx.Where(&models.SigningKey{KID: kid}).Where("state <> ?", models.KeyStateRetired).First(&key).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrKeyNotFound
+			}
+			return err
+		}
+
+		rows, err := lockAlgorithm(tx, key.Algorithm)
+		if err != nil {
+			return err
+		}
+		if key.State == models.KeyStateActive {
+			if err := replaceActive(tx, &key, rows); err != nil {
+				return err
+			}
+		}
+
+		res := tx.Model(&models.SigningKey{}).
+			Where(&models.SigningKey{KID: kid}).Where("state <> ?", models.KeyStateRetired).
+			Updates(map[string]interface{}{"state": models.KeyStateRetired, "retired_at": time.Now(), "private_jwk": ""})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrKeyNotFound
+		}
+		return nil
+	})
+}
+
+// replaceActive activates the pending key of key's algorithm if key is the
+// last active one. Without a pending key the retirement is refused, nothing
+// relying parties know about could take over.
+func replaceActive(tx *gorm.DB, key *models.SigningKey, rows []models.SigningKey) error {
+	var pending *models.SigningKey
+	for i := range rows {
+		switch row := &rows[i]; {
+		case row.KID == key.KID:
+		case row.State == models.KeyStateActive:
+			return nil
+		case row.State == models.KeyStatePending && pending == nil:
+			pending = row
+		}
+	}
+	if pending == nil {
+		return fmt.Errorf("%w: %s", ErrLastActiveKey, key.Algorithm)
+	}
+
+	if err := tx.Model(pending).Updates(map[string]interface{}{"state": models.KeyStateActive, "activated_at": time.Now()}).Error; err != nil {
+		return err
+	}
+	log.Info("Activated %s key %s to replace %s", key.Algorithm, pending.KID, key.KID)
+
+	next, err := Create(tx, jwa.SignatureAlgorithm(key.Algorithm), models.KeyStatePending)
+	if errors.Is(err, ErrUnsupportedAlgorithm) {
+		// Imported keys may use an algorithm we can't generate keys for
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Info("Generated pending %s key %s", key.Algorithm, next.KID)
+
+	return nil
+}
+
+// Rotate moves every algorithm one step through the lifecycle: retiring keys
+// are retired, active keys start retiring, pending keys become active and a
+// new pending key is generated.
+func Rotate(algs []jwa.SignatureAlgorithm) error {
+	for _, alg := range algs {
+		err := models.DB.Transaction(func(tx *gorm.DB) error {
+			rows, err := lockAlgorithm(tx, alg.String())
+			if err != nil {
+				return err
+			}
+
+			now := time.Now()
+			var active, pending *models.SigningKey
+			for i := range rows {
+				switch row := &rows[i]; row.State {
+				case models.KeyStateActive:
+					if active == nil || (row.ActivatedAt != nil && (active.ActivatedAt == nil || row.ActivatedAt.After(*active.ActivatedAt))) {
+						active = row
+					}
+				case models.KeyStatePending:
+					if pending == nil {
+						pending = row
+					}
+				}
+			}
+			if active != nil && active.ActivatedAt != nil && now.Sub(*active.ActivatedAt) < MinActiveAge {
+				log.Debug("Skipping rotation of %s, key %s was only just activated", alg, active.KID)
+				return nil
+			}
+
+			// Nothing was published ahead of time, so relying parties may not
+			// know about a replacement yet. Publish one and rotate next time.
+			if pending == nil {
+				_, err := Create(tx, alg, models.KeyStatePending)
+				return err
+			}
+
+			if err := tx.Model(&models.SigningKey{}).
+				Where("algorithm = ? AND state = ?", alg.String(), models.KeyStateRetiring).
+				Updates(map[string]interface{}{"state": models.KeyStateRetired, "retired_at": now, "private_jwk": ""}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&models.SigningKey{}).
+				Where("algorithm = ? AND state = ?", alg.String(), models.KeyStateActive).
+				Updates(map[string]interface{}{"state": models.KeyStateRetiring, "retiring_at": now}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(pending).Updates(map[string]interface{}{"state": models.KeyStateActive, "activated_at": now}).Error; err != nil {
+				return err
+			}
+
+			next, err := Create(tx, alg, models.KeyStatePending)
+			if err != nil {
+				return err
+			}
+			log.Info("Rotated %s keys, %s is now active and %s is pending", alg, pending.KID, next.KID)
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return Load()
+}
+
+// lockAlgorithm locks every key of alg until tx ends. Replicas rotating on the
+// same schedule take turns, and the second one sees the key the first one
+// just activated instead of rotating again.
+func lockAlgorithm(tx *gorm.DB, alg string) ([]models.SigningKey, error) {
+	var rows []models.SigningKey
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("algorithm = ?", alg).Order("id").Find(&rows).Error
+	return rows, err
+}
@@ -0,0 +1,280 @@
+package keys
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/database/models/modelstest"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+)
+
+func setupDB(t *testing.T) {
+	t.Helper()
+
+	modelstest.Setup(t)
+
+	dir, kek, minActiveAge := Dir, KEK, MinActiveAge
+	t.Cleanup(func() {
+		Dir, KEK, MinActiveAge = dir, kek, minActiveAge
+	})
+	Dir, KEK = "", nil
+}
+
+// states counts the keys of alg in each state.
+func states(t *testing.T, alg jwa.SignatureAlgorithm) map[string]int {
+	t.Helper()
+
+	rows, err := List()
+	if err != nil {
+		t.Fatalf("listing keys: %s", err)
+	}
+	ret := map[string]int{}
+	for _, row := range rows {
+		if row.Algorithm == alg.String() {
+			ret[row.State]++
+		}
+	}
+	return ret
+}
+
+func TestRotate(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        func(t *testing.T)
+		minActiveAge time.Duration
+		rotations    int
+		want         map[string]int
+	}{
+		{
+			name:         "a key that was only just activated is kept",
+			setup:        func(t *testing.T) { Ensure([]jwa.SignatureAlgorithm{jwa.ES256}) },
+			minActiveAge: time.Hour,
+			rotations:    1,
+			want:         map[string]int{models.KeyStateActive: 1, models.KeyStatePending: 1},
+		},
+		{
+			name:      "the pending key becomes active",
+			setup:     func(t *testing.T) { Ensure([]jwa.SignatureAlgorithm{jwa.ES256}) },
+			rotations: 1,
+			want:      map[string]int{models.KeyStateRetiring: 1, models.KeyStateActive: 1, models.KeyStatePending: 1},
+		},
+		{
+			name:      "retiring keys are retired",
+			setup:     func(t *testing.T) { Ensure([]jwa.SignatureAlgorithm{jwa.ES256}) },
+			rotations: 2,
+			want:      map[string]int{models.KeyStateRetired: 1, models.KeyStateRetiring: 1, models.KeyStateActive: 1, models.KeyStatePending: 1},
+		},
+		{
+			name: "without a pending key one is published first",
+			setup: func(t *testing.T) {
+				if _, err := Create(models.DB, jwa.ES256, models.KeyStateActive); err != nil {
+					t.Fatalf("creating key: %s", err)
+				}
+			},
+			rotations: 1,
+			want:      map[string]int{models.KeyStateActive: 1, models.KeyStatePending: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupDB(t)
+			tt.setup(t)
+			MinActiveAge = tt.minActiveAge
+
+			for i := 0; i < tt.rotations; i++ {
+				if err := Rotate([]jwa.SignatureAlgorithm{jwa.ES256}); err != nil {
+					t.Fatalf("rotating: %s", err)
+				}
+			}
+
+			got := states(t, jwa.ES256)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRotateWipesRetiredKeys(t *testing.T) {
+	setupDB(t)
+	MinActiveAge = 0
+	if err := Ensure([]jwa.SignatureAlgorithm{jwa.ES256}); err != nil {
+		t.Fatalf("ensuring keys: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := Rotate([]jwa.SignatureAlgorithm{jwa.ES256}); err != nil {
+			t.Fatalf("rotating: %s", err)
+		}
+	}
+
+	retired := models.SigningKey{}
+	if err := models.DB.Where("state = ?", models.KeyStateRetired).First(&retired).Error; err != nil {
+		t.Fatalf("finding the retired key: %s", err)
+	}
+	if retired.PrivateJWK != "" {
+		t.Errorf("expected the retired key's private material to be wiped")
+	}
+}
+
+func TestSeal(t *testing.T) {
+	kek := []byte("0123456789abcdef0123456789abcdef")
+
+	tests := []struct {
+		name    string
+		sealKEK []byte
+		openKEK []byte
+		openKID string
+		wantErr bool
+	}{
+		{name: "plaintext without a KEK", openKID: "kid"},
+		{name: "encrypted with a KEK", sealKEK: kek, openKEK: kek, openKID: "kid"},
+		{name: "bound to the kid", sealKEK: kek, openKEK: kek, openKID: "other", wantErr: true},
+		{name: "needs the KEK to open", sealKEK: kek, openKID: "kid", wantErr: true},
+		{name: "plaintext still opens with a KEK", openKEK: kek, openKID: "kid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(kek []byte) { KEK = kek }(KEK)
+
+			KEK = tt.sealKEK
+			sealed, err := seal("kid", []byte(`{"kty":"oct"}`))
+			if err != nil {
+				t.Fatalf("sealing: %s", err)
+			}
+			if tt.sealKEK != nil && strings.Contains(sealed, "oct") {
+				t.Fatalf("expected the key to be encrypted, got %s", sealed)
+			}
+
+			KEK = tt.openKEK
+			opened, err := unseal(tt.openKID, sealed)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %s", opened)
+				}
+				return
+			}
+			if err != nil || string(opened) != `{"kty":"oct"}` {
+				t.Errorf("expected the key back, got %q: %v", opened, err)
+			}
+		})
+	}
+}
+
+func TestLoadDecryptsStoredKeys(t *testing.T) {
+	setupDB(t)
+	KEK = []byte("0123456789abcdef0123456789abcdef")
+
+	sk, err := Create(models.DB, jwa.ES256, models.KeyStateActive)
+	if err != nil {
+		t.Fatalf("creating key: %s", err)
+	}
+	if !strings.HasPrefix(sk.PrivateJWK, sealedPrefix) {
+		t.Fatalf("expected the key to be stored encrypted")
+	}
+
+	signing, _, err := load()
+	if err != nil || signing.Len() != 1 {
+		t.Fatalf("expected the key to sign, got %v keys: %v", signing, err)
+	}
+}
+
+func TestParseKEK(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr error
+	}{
+		{in: base64.StdEncoding.EncodeToString(make([]byte, 32))},
+		{in: base64.StdEncoding.EncodeToString(make([]byte, 16)), wantErr: ErrInvalidKEK},
+		{in: "not base64!", wantErr: ErrInvalidKEK},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseKEK(tt.in); !errors.Is(err, tt.wantErr) {
+			t.Errorf("ParseKEK(%q): expected %v, got %v", tt.in, tt.wantErr, err)
+		}
+	}
+}
+
+func TestRetire(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T) string // Returns the kid to retire
+		wantErr error
+		want    map[string]int
+	}{
+		{
+			name: "the pending key replaces the last active key",
+			setup: func(t *testing.T) string {
+				Ensure([]jwa.SignatureAlgorithm{jwa.ES256})
+				return kidIn(t, models.KeyStateActive)
+			},
+			want: map[string]int{models.KeyStateRetired: 1, models.KeyStateActive: 1, models.KeyStatePending: 1},
+		},
+		{
+			name: "another active key keeps signing",
+			setup: func(t *testing.T) string {
+				Ensure([]jwa.SignatureAlgorithm{jwa.ES256})
+				Create(models.DB, jwa.ES256, models.KeyStateActive)
+				return kidIn(t, models.KeyStateActive)
+			},
+			want: map[string]int{models.KeyStateRetired: 1, models.KeyStateActive: 1, models.KeyStatePending: 1},
+		},
+		{
+			name: "the last active key without a pending key is kept",
+			setup: func(t *testing.T) string {
+				Create(models.DB, jwa.ES256, models.KeyStateActive)
+				return kidIn(t, models.KeyStateActive)
+			},
+			wantErr: ErrLastActiveKey,
+			want:    map[string]int{models.KeyStateActive: 1},
+		},
+		{
+			name: "pending keys are retired without a replacement",
+			setup: func(t *testing.T) string {
+				Ensure([]jwa.SignatureAlgorithm{jwa.ES256})
+				return kidIn(t, models.KeyStatePending)
+			},
+			want: map[string]int{models.KeyStateRetired: 1, models.KeyStateActive: 1},
+		},
+		{
+			name:    "unknown keys",
+			setup:   func(t *testing.T) string { return "unknown" },
+			wantErr: ErrKeyNotFound,
+			want:    map[string]int{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupDB(t)
+			kid := tt.setup(t)
+
+			if err := Retire(kid); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+
+			got := states(t, jwa.ES256)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func kidIn(t *testing.T, state string) string {
+	t.Helper()
+
+	key := models.SigningKey{}
+	if err := models.DB.Where("state = ?", state).Order("id").First(&key).Error; err != nil {
+		t.Fatalf("finding a %s key: %s", state, err)
+	}
+	return key.KID
+}
@@ -0,0 +1,175 @@
+package login
+
+import (
+	"context"
+	"fmt"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/pkg/clients"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+const ClientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// Authenticate authenticates a client by whichever method it presented and
+// checks that is the method the client is configured for. audiences are the
+// values a client assertion's aud may have.
+func Authenticate(ctx context.Context, auth ClientAuth, audiences []string) (*dbTypes.OAuthClient, error) {
+	if auth.ClientAssertion != "" || auth.ClientAssertionType != "" {
+		// RFC7521 4.2, only one method per request
+		if auth.ClientSecret != "" || auth.Basic {
+			return nil, ErrInvalidRequest
+		}
+		return authenticateAssertion(ctx, auth, audiences)
+	}
+
+	if auth.ClientID == "" {
+		return nil, ErrInvalidClient
+	}
+
+	client, settings, err := findClient(auth.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Public clients only identify themselves, PKCE protects their codes
+	if auth.ClientSecret == "" {
+		if !methodAllowed(settings, models.AuthMethodNone) {
+			return nil, ErrInvalidClient
+		}
+		return client, nil
+	}
+
+	method := models.AuthMethodClientSecretPost
+	if auth.Basic {
+		method = models.AuthMethodClientSecretBasic
+	}
+	if !methodAllowed(settings, method) {
+		return nil, ErrInvalidClient
+	}
+
+	ok, err := clients.VerifySecret(client, auth.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidClient
+	}
+
+	return client, nil
+}
+
+// authenticateAssertion authenticates a RFC7523 client assertion. HMAC signed
+// assertions are client_secret_jwt, anything else must be signed by one of
+// the client's registered keys.
+func authenticateAssertion(ctx context.Context, auth ClientAuth, audiences []string) (*dbTypes.OAuthClient, error) {
+	if auth.ClientAssertionType != ClientAssertionTypeJWTBearer || auth.ClientAssertion == "" {
+		return nil, ErrInvalidClient
+	}
+
+	msg, err := jws.Parse([]byte(auth.ClientAssertion))
+	if err != nil || len(msg.Signatures()) != 1 {
+		return nil, ErrInvalidClient
+	}
+	alg := msg.Signatures()[0].ProtectedHeaders().Algorithm()
+
+	// Only to find the client, nothing in it is trusted before it is verified
+	unverified, err := jwt.Parse([]byte(auth.ClientAssertion), jwt.WithVerify(false))
+	if err != nil {
+		return nil, ErrInvalidClient
+	}
+	clientID := unverified.Subject()
+	if clientID == "" || (auth.ClientID != "" && auth.ClientID != clientID) {
+		return nil, ErrInvalidClient
+	}
+
+	client, settings, err := findClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	var token jwt.Token
+	switch alg {
+	case jwa.HS256, jwa.HS384, jwa.HS512:
+		if !methodAllowed(settings, models.AuthMethodClientSecretJWT) {
+			return nil, ErrInvalidClient
+		}
+		secrets, serr := clients.HMACSecrets(client)
+		if serr != nil {
+			return nil, serr
+		}
+		err = ErrInvalidClient
+		for _, secret := range secrets {
+			if token, err = jwt.Parse([]byte(auth.ClientAssertion), jwt.WithKey(alg, []byte(secret)), jwt.WithValidate(true)); err == nil {
+				break
+			}
+		}
+	default:
+		if !methodAllowed(settings, models.AuthMethodPrivateKeyJWT) {
+			return nil, ErrInvalidClient
+		}
+		keys, kerr := ClientKeys(ctx, settings)
+		if kerr != nil {
+			return nil, ErrInvalidClient
+		}
+		token, err = jwt.Parse([]byte(auth.ClientAssertion),
+			jwt.WithKeySet(keys, jws.WithRequireKid(false), jws.WithInferAlgorithmFromKey(true)),
+			jwt.WithValidate(true),
+		)
+	}
+	if err != nil {
+		return nil, ErrInvalidClient
+	}
+
+	// RFC7523 3, iss and sub are the client, aud is us, exp and jti are required
+	if token.Issuer() != clientID || token.Subject() != clientID {
+		return nil, ErrInvalidClient
+	}
+	if !containsAny(token.Audience(), audiences) {
+		return nil, ErrInvalidClient
+	}
+	if token.Expiration().IsZero() || token.JwtID() == "" {
+		return nil, ErrInvalidClient
+	}
+
+	if err := models.DB.Create(&models.OAuthClientAssertion{
+		ClientID:  clientID,
+		JTI:       token.JwtID(),
+		ExpiresAt: token.Expiration(),
+	}).Error; err != nil {
+		if !models.IsDuplicateKey(err) {
+			return nil, fmt.Errorf("recording client assertion: %w", err)
+		}
+		securityLog.Warning("Client assertion %s replayed for client %s", token.JwtID(), clientID)
+		return nil, ErrInvalidClient
+	}
+
+	return client, nil
+}
+
+func findClient(clientID string) (*dbTypes.OAuthClient, *models.OAuthClientSettings, error) {
+	client := dbTypes.OAuthClient{}
+	if err := models.DB.Where("client_id = ?", clientID).First(&client).Error; err != nil {
+		return nil, nil, ErrInvalidClient
+	}
+
+	settings, err := models.GetClientSettings(client.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading client settings: %w", err)
+	}
+
+	return &client, settings, nil
+}
+
+// methodAllowed reports whether the client may authenticate with method,
+// clients without a configured method may use either secret method. Only
+// public clients may use none.
+func methodAllowed(settings *models.OAuthClientSettings, method string) bool {
+	if settings.TokenEndpointAuthMethod == "" {
+		return method == models.AuthMethodClientSecretBasic || method == models.AuthMethodClientSecretPost
+	}
+	return settings.TokenEndpointAuthMethod == method
+}
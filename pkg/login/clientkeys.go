@@ -0,0 +1,63 @@
+package login
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/pkg/clients"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+var (
+	ErrNoClientKeys   = errors.New("client has no registered keys")
+	ErrInvalidJWKSURI = errors.New("jwks_uri must be an https URL")
+)
+
+// How often a client's jwks_uri is fetched again at most, so a client rotating
+// its keys is picked up without fetching on every token
+var ClientKeysRefreshInterval = time.Minute * 15
+
+// Like request objects, a jwks_uri is fetched without following redirects or
+// dialing internal addresses
+var clientKeysHTTPClient = &http.Client{
+	Timeout:   5 * time.Second,
+	Transport: externalTransport(),
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var (
+	clientKeyCache     *jwk.Cache
+	clientKeyCacheOnce sync.Once
+)
+
+// ClientKeys returns the public keys a client registered, either inline or
+// through a jwks_uri.
+func ClientKeys(ctx context.Context, settings *models.OAuthClientSettings) (jwk.Set, error) {
+	if settings.JWKS != "" {
+		return jwk.Parse([]byte(settings.JWKS))
+	}
+	if settings.JWKSURI == "" {
+		return nil, ErrNoClientKeys
+	}
+
+	if err := clients.ValidateFetchURI(settings.JWKSURI); err != nil {
+		return nil, ErrInvalidJWKSURI
+	}
+
+	clientKeyCacheOnce.Do(func() {
+		clientKeyCache = jwk.NewCache(context.Background())
+	})
+	if !clientKeyCache.IsRegistered(settings.JWKSURI) {
+		if err := clientKeyCache.Register(settings.JWKSURI, jwk.WithMinRefreshInterval(ClientKeysRefreshInterval), jwk.WithHTTPClient(clientKeysHTTPClient)); err != nil {
+			return nil, err
+		}
+	}
+
+	return clientKeyCache.Get(ctx, settings.JWKSURI)
+}
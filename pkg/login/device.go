@@ -0,0 +1,169 @@
+package login
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/models"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"gorm.io/gorm/clause"
+)
+
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+var (
+	DeviceCodeLifetime = time.Minute * 10
+	DeviceCodeInterval = 5
+
+	// RFC8628 5.1, user codes are short enough to guess, so only this many
+	// wrong codes per IP are accepted within a DeviceCodeLifetime
+	MaxUserCodeAttempts = 10
+)
+
+// RFC8628 6.1 recommends a base-20 alphabet without vowels so codes are easy
+// to type and can't spell anything
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+var (
+	ErrAuthorizationPending error = errors.New("authorization_pending")
+	ErrSlowDown             error = errors.New("slow_down")
+	ErrExpiredToken         error = errors.New("expired_token")
+	ErrAccessDenied         error = errors.New("access_denied")
+	ErrTooManyAttempts      error = errors.New("too many attempts")
+)
+
+func CreateDeviceCode(client *dbTypes.OAuthClient, scope string) (*models.OAuthDeviceCode, error) {
+	deviceCode, err := gonanoid.New(48)
+	if err != nil {
+		return nil, err
+	}
+	userCode, err := gonanoid.Generate(userCodeAlphabet, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	device := models.OAuthDeviceCode{
+		DeviceCode: deviceCode,
+		UserCode:   FormatUserCode(userCode),
+		ClientID:   client.ID,
+		Client:     *client,
+		Scope:      scope,
+		Interval:   DeviceCodeInterval,
+		ExpiresAt:  time.Now().Add(DeviceCodeLifetime),
+	}
+	if err := models.DB.Create(&device).Error; err != nil {
+		return nil, err
+	}
+
+	return &device, nil
+}
+
+// FormatUserCode normalizes whatever the user typed into the XXXX-XXXX form
+// user codes are stored in.
+func FormatUserCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	if len(code) != 8 {
+		return code
+	}
+	return fmt.Sprintf("%s-%s", code[:4], code[4:])
+}
+
+// FindDeviceByUserCode returns the pending device authorization for the code
+// the user entered from ip. Wrong codes count against ip's attempts.
+func FindDeviceByUserCode(userCode, ip string) (*models.OAuthDeviceCode, error) {
+	now := time.Now()
+	var attempts int64
+	if err := models.DB.Model(&models.OAuthDeviceAttempt{}).Where("ip = ? AND expires_at > ?", ip, now).Count(&attempts).Error; err != nil {
+		return nil, err
+	}
+	if attempts >= int64(MaxUserCodeAttempts) {
+		securityLog.Warning("Too many wrong user codes from %s", ip)
+		return nil, ErrTooManyAttempts
+	}
+
+	device := models.OAuthDeviceCode{}
+	if err := models.DB.Joins("Client").Where("user_code = ? AND approved = ? AND denied = ?", FormatUserCode(userCode), false, false).First(&device).Error; err != nil {
+		if err := models.DB.Create(&models.OAuthDeviceAttempt{IP: ip, ExpiresAt: now.Add(DeviceCodeLifetime)}).Error; err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidRequest
+	}
+	if now.After(device.ExpiresAt) {
+		return nil, ErrExpiredToken
+	}
+	return &device, nil
+}
+
+// DenyDevice records that the user turned the device authorization down, the
+// device gets access_denied on its next poll.
+func DenyDevice(device *models.OAuthDeviceCode) error {
+	return models.DB.Model(&models.OAuthDeviceCode{}).Where("id = ? AND approved = ?", device.ID, false).Update("denied", true).Error
+}
+
+func DeviceCode(client *dbTypes.OAuthClient, req TokenRequest) (*dbTypes.OAuthLogin, *dbTypes.User, error) {
+	if req.DeviceCode == "" {
+		return nil, nil, ErrInvalidRequest
+	}
+
+	device := models.OAuthDeviceCode{}
+	if err := models.DB.Joins("Client").Where("device_code = ?", req.DeviceCode).First(&device).Error; err != nil {
+		return nil, nil, ErrInvalidGrant
+	}
+
+	if device.ClientID != client.ID {
+		return nil, nil, ErrInvalidGrant
+	}
+
+	if time.Now().After(device.ExpiresAt) {
+		models.DB.Delete(&device)
+		return nil, nil, ErrExpiredToken
+	}
+
+	now := time.Now()
+	if device.LastPolledAt != nil && now.Sub(*device.LastPolledAt) < time.Duration(device.Interval)*time.Second {
+		// RFC8628 3.5, every slow_down adds 5 seconds to the interval
+		device.Interval += 5
+		device.LastPolledAt = &now
+		models.DB.Save(&device)
+		return nil, nil, ErrSlowDown
+	}
+	device.LastPolledAt = &now
+
+	if device.Denied {
+		models.DB.Delete(&device)
+		return nil, nil, ErrAccessDenied
+	}
+
+	if !device.Approved {
+		models.DB.Save(&device)
+		return nil, nil, ErrAuthorizationPending
+	}
+
+	// Concurrent polls both see the approval, only the one that deletes the
+	// row gets the tokens
+	result := models.DB.Where("device_code = ? AND approved = ?", req.DeviceCode, true).Delete(&models.OAuthDeviceCode{})
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, nil, ErrInvalidGrant
+	}
+
+	user := dbTypes.User{}
+	if err := models.DB.Preload(clause.Associations).Where(dbTypes.User{CID: device.CID}).First(&user).Error; err != nil {
+		return nil, nil, ErrInvalidRequest
+	}
+
+	login := dbTypes.OAuthLogin{
+		Client:   device.Client,
+		ClientID: device.ClientID,
+		CID:      device.CID,
+		Scope:    device.Scope,
+	}
+
+	return &login, &user, nil
+}
@@ -0,0 +1,42 @@
+package login
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+var errInternalAddress = errors.New("refusing to connect to an internal address")
+
+// externalTransport is used for the jwks_uri and request_uri a client points
+// us at. Those are checked when registered, but a hostname can resolve to an
+// internal address later, so the address is checked again when dialing. It
+// doesn't use a proxy, the proxy is what would be dialed.
+func externalTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: dialExternal,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// dialExternal refuses loopback, private, link-local and unspecified
+// addresses. It runs after the name is resolved, on every address tried.
+func dialExternal(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("%w: %s", errInternalAddress, host)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package login
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDialExternal(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{address: "93.184.216.34:443"},
+		{address: "[2606:2800:220:1:248:1893:25c8:1946]:443"},
+		{address: "127.0.0.1:443", wantErr: true},
+		{address: "[::1]:443", wantErr: true},
+		{address: "10.0.0.1:443", wantErr: true},
+		{address: "172.16.0.1:443", wantErr: true},
+		{address: "192.168.1.1:443", wantErr: true},
+		{address: "[fd00::1]:443", wantErr: true},
+		{address: "169.254.169.254:80", wantErr: true},
+		{address: "[fe80::1]:443", wantErr: true},
+		{address: "0.0.0.0:443", wantErr: true},
+		{address: "[::]:443", wantErr: true},
+		{address: "[::ffff:127.0.0.1]:443", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := dialExternal("tcp", tt.address, nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected an error %v, got %v", tt.address, tt.wantErr, err)
+		}
+	}
+}
+
+func TestFetchInternalAddress(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer server.Close()
+
+	// A registered hostname can resolve to the loopback address later on
+	for name, client := range map[string]*http.Client{"request_uri": RequestURIClient, "jwks_uri": clientKeysHTTPClient} {
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !errors.Is(err, errInternalAddress) {
+			t.Errorf("%s: expected the loopback address to be refused, got %v", name, err)
+		}
+	}
+}
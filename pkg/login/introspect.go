@@ -0,0 +1,134 @@
+package login
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/models"
+	"gorm.io/gorm/clause"
+)
+
+// Introspection is the RFC7662 response for a token, inactive tokens must
+// only ever return active: false.
+type Introspection struct {
+	Active    bool     `json:"active"`
+	Sub       string   `json:"sub,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	Exp       int64    `json:"exp,omitempty"`
+	Iat       int64    `json:"iat,omitempty"`
+	Iss       string   `json:"iss,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+}
+
+var inactive = &Introspection{Active: false}
+
+// Introspect looks the token up as both an access token and a refresh token,
+// the hint only decides which is tried first.
+func Introspect(token, hint string) *Introspection {
+	if hint == "refresh_token" {
+		if ret := introspectRefreshToken(token); ret.Active {
+			return ret
+		}
+		return introspectAccessToken(token)
+	}
+
+	if ret := introspectAccessToken(token); ret.Active {
+		return ret
+	}
+	return introspectRefreshToken(token)
+}
+
+func introspectAccessToken(token string) *Introspection {
+	t, err := ResolveAccessToken(token)
+	if err != nil {
+		return inactive
+	}
+
+	ret := &Introspection{
+		Active:    true,
+		Sub:       t.Subject,
+		ClientID:  t.ClientID,
+		Scope:     t.Scope,
+		Exp:       t.ExpiresAt.Unix(),
+		Iat:       t.IssuedAt.Unix(),
+		Iss:       t.Issuer,
+		TokenType: "access_token",
+	}
+
+	// There is no user behind a token the client got for itself
+	if t.IsClientToken() {
+		return ret
+	}
+
+	cid, err := strconv.ParseUint(ret.Sub, 10, 32)
+	if err != nil {
+		return inactive
+	}
+
+	user, err := findUser(uint(cid))
+	if err != nil {
+		return inactive
+	}
+	ret.Roles = roleNames(user)
+
+	return ret
+}
+
+func introspectRefreshToken(token string) *Introspection {
+	login, err := FindRefreshToken(token)
+	if err != nil {
+		return inactive
+	}
+
+	user, err := findUser(login.CID)
+	if err != nil {
+		return inactive
+	}
+
+	return &Introspection{
+		Active:    true,
+		Sub:       fmt.Sprint(login.CID),
+		ClientID:  login.Client.ClientID,
+		Scope:     login.Scope,
+		Exp:       login.ExpiresAt.Unix(),
+		Iat:       login.CreatedAt.Unix(),
+		TokenType: "refresh_token",
+		Roles:     roleNames(user),
+	}
+}
+
+// FindRefreshToken returns the stored refresh token if it is still valid.
+// Refresh tokens are the OAuthLogin rows without a code or redirect uri, any
+// other row belongs to an authorization in progress.
+func FindRefreshToken(token string) (*dbTypes.OAuthLogin, error) {
+	if token == "" {
+		return nil, ErrInvalidRequest
+	}
+
+	login := dbTypes.OAuthLogin{}
+	if err := models.DB.Joins("Client").Where("token = ? AND code = '' AND redirect_uri = '' AND expires_at > ?", token, time.Now()).First(&login).Error; err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	return &login, nil
+}
+
+func findUser(cid uint) (*dbTypes.User, error) {
+	user := dbTypes.User{}
+	if err := models.DB.Preload(clause.Associations).Where(dbTypes.User{CID: cid}).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func roleNames(user *dbTypes.User) []string {
+	roles := []string{}
+	for _, role := range user.Roles {
+		roles = append(roles, role.Name)
+	}
+	return roles
+}
@@ -0,0 +1,46 @@
+package login
+
+import (
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/models"
+)
+
+// How long an authorization code may wait to be exchanged, the pending login
+// it is issued for gets as long to come back from the upstream login
+var AuthorizationCodeLifetime = time.Minute * 5
+
+// Lifetimes are how long the tokens issued to a client live.
+type Lifetimes struct {
+	AccessToken     int // Seconds, like OAuthClient.TTL
+	IDToken         int // Seconds
+	RefreshIdle     time.Duration
+	RefreshAbsolute time.Duration
+}
+
+// LifetimesFor returns the client's configured lifetimes, falling back to its
+// TTL for access and id tokens and to the defaults for refresh tokens.
+func LifetimesFor(client *dbTypes.OAuthClient, settings *models.OAuthClientSettings) Lifetimes {
+	ret := Lifetimes{
+		AccessToken:     client.TTL,
+		IDToken:         client.TTL,
+		RefreshIdle:     RefreshTokenLifetime,
+		RefreshAbsolute: RefreshFamilyLifetime,
+	}
+
+	if settings.AccessTokenLifetime > 0 {
+		ret.AccessToken = settings.AccessTokenLifetime
+	}
+	if settings.IDTokenLifetime > 0 {
+		ret.IDToken = settings.IDTokenLifetime
+	}
+	if settings.RefreshTokenIdleLifetime > 0 {
+		ret.RefreshIdle = time.Duration(settings.RefreshTokenIdleLifetime) * time.Second
+	}
+	if settings.RefreshTokenAbsoluteLifetime > 0 {
+		ret.RefreshAbsolute = time.Duration(settings.RefreshTokenAbsoluteLifetime) * time.Second
+	}
+
+	return ret
+}
@@ -8,15 +8,25 @@ import (
 	dbTypes "github.com/adh-partnership/api/pkg/database/models"
 	"github.com/adh-partnership/sso/database/models"
 	"github.com/adh-partnership/sso/pkg/pkce"
-	gonanoid "github.com/matoous/go-nanoid/v2"
+	"github.com/adh-partnership/sso/pkg/scopes"
 	"gorm.io/gorm/clause"
 )
 
+// ClientAuth holds the credentials a client presented, either in the request
+// body or through an HTTP Basic Authorization header.
+type ClientAuth struct {
+	ClientID            string `form:"client_id" json:"client_id"`
+	ClientSecret        string `form:"client_secret" json:"client_secret"`
+	ClientAssertion     string `form:"client_assertion" json:"client_assertion"`
+	ClientAssertionType string `form:"client_assertion_type" json:"client_assertion_type"`
+	Basic               bool   `form:"-" json:"-"` // Credentials came from the Authorization header
+}
+
 type TokenRequest struct {
+	ClientAuth
 	GrantType    string   `form:"grant_type" json:"grant_type"`
-	ClientID     string   `form:"client_id" json:"client_id"`
-	ClientSecret string   `form:"client_secret" json:"client_secret"`
 	RefreshToken string   `form:"refresh_token" json:"refresh_token"`
+	DeviceCode   string   `form:"device_code" json:"device_code"`
 	Code         string   `form:"code" json:"code"`
 	RedirectURI  string   `form:"redirect_uri" json:"redirect_uri"`
 	CodeVerifier string   `form:"code_verifier" json:"code_verifier"`
@@ -30,33 +40,78 @@ var (
 	ErrInvalidGrant   error = errors.New("invalid_grant")
 	ErrInvalidToken   error = errors.New("invalid_token")
 	ErrTokenExpired   error = errors.New("token_expired")
+	ErrInvalidScope   error = errors.New("invalid_scope")
+
+	ErrUnsupportedGrantType error = errors.New("unsupported_grant_type")
 )
 
-func HandleGrantType(req TokenRequest) (*dbTypes.OAuthLogin, *dbTypes.User, error) {
+// HandleGrantType runs the requested grant for client, which the caller must
+// already have authenticated.
+func HandleGrantType(client *dbTypes.OAuthClient, req TokenRequest) (*dbTypes.OAuthLogin, *dbTypes.User, error) {
+	settings, err := models.GetClientSettings(client.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !settings.AllowsGrantType(req.GrantType) {
+		return nil, nil, ErrUnauthorizedClient
+	}
+
 	switch req.GrantType {
 	case "authorization_code":
-		return AuthorizationCode(req)
+		return AuthorizationCode(client, req)
 	case "refresh_token":
-		return RefreshToken(req)
+		return RefreshToken(client, req)
+	case "client_credentials":
+		return ClientCredentials(client, req)
+	case DeviceCodeGrantType:
+		return DeviceCode(client, req)
 	default:
-		return nil, nil, ErrInvalidGrant
+		return nil, nil, ErrUnsupportedGrantType
 	}
 }
 
-func AuthorizationCode(req TokenRequest) (*dbTypes.OAuthLogin, *dbTypes.User, error) {
+func AuthorizationCode(client *dbTypes.OAuthClient, req TokenRequest) (*dbTypes.OAuthLogin, *dbTypes.User, error) {
+	if req.Code == "" {
+		return nil, nil, ErrInvalidRequest
+	}
+
 	login := dbTypes.OAuthLogin{}
 	if err := models.DB.Joins("Client").Where("code = ?", req.Code).First(&login).Error; err != nil {
-		return nil, nil, ErrInvalidRequest
+		return nil, nil, ErrInvalidGrant
+	}
+
+	// The code is used up whether or not the exchange succeeds, and of two
+	// concurrent exchanges only the one that deletes it gets the tokens
+	result := models.DB.Where("code = ?", req.Code).Delete(&dbTypes.OAuthLogin{})
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, nil, ErrInvalidGrant
+	}
+
+	if time.Now().After(login.ExpiresAt) {
+		return nil, nil, ErrInvalidGrant
+	}
+
+	// RFC6749 4.1.3, the code must have been issued to the client
+	if login.ClientID != client.ID {
+		return nil, nil, ErrInvalidGrant
+	}
+
+	// RFC6749 4.1.3, the redirect uri must match the one the code was issued for
+	if req.RedirectURI != login.RedirectURI {
+		return nil, nil, ErrInvalidGrant
 	}
-	defer models.DB.Delete(&login)
 
-	if req.ClientID != login.Client.ClientID || req.ClientSecret != login.Client.ClientSecret {
-		return nil, nil, ErrInvalidClient
+	settings, err := models.GetClientSettings(client.ID)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Was the request PKCE'd?
-	if login.CodeChallengeMethod == "S256" {
-		if !pkce.VerifyCodeVerifierS256(login.CodeChallenge, req.CodeVerifier) {
+	// Was the request PKCE'd? It has to be for clients that require it
+	if login.CodeChallengeMethod == "S256" || settings.RequiresPKCE() {
+		if login.CodeChallengeMethod != "S256" || !pkce.VerifyCodeVerifierS256(login.CodeChallenge, req.CodeVerifier) {
 			return nil, nil, ErrInvalidGrant
 		}
 	}
@@ -69,66 +124,69 @@ func AuthorizationCode(req TokenRequest) (*dbTypes.OAuthLogin, *dbTypes.User, er
 	return &login, &user, nil
 }
 
-func RefreshToken(req TokenRequest) (*dbTypes.OAuthLogin, *dbTypes.User, error) {
-	if req.RefreshToken == "" {
-		return nil, nil, ErrInvalidRequest
+// ClientCredentials returns a login without a user, the client itself is the
+// subject of the issued token. No user is returned, so callers must not issue
+// id or refresh tokens for it.
+func ClientCredentials(client *dbTypes.OAuthClient, req TokenRequest) (*dbTypes.OAuthLogin, *dbTypes.User, error) {
+	// A public client can't prove it is the client, so it can't be the subject
+	settings, err := models.GetClientSettings(client.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if settings.IsPublic() {
+		return nil, nil, ErrUnauthorizedClient
 	}
 
-	login := dbTypes.OAuthLogin{}
-	if err := models.DB.Joins("Client").Where(dbTypes.OAuthLogin{Token: req.RefreshToken}).First(&login).Error; err != nil {
-		return nil, nil, ErrInvalidRequest
+	requested := SplitScopes(req.Scope)
+	if err := ValidateScopes(client, requested); err != nil {
+		return nil, nil, err
+	}
+	for _, name := range requested {
+		if scope, _ := scopes.Get(name); scope.RequiresUser {
+			return nil, nil, ErrInvalidScope
+		}
 	}
-	defer models.DB.Delete(&login)
 
-	if req.ClientID != login.Client.ClientID || req.ClientSecret != login.Client.ClientSecret {
-		return nil, nil, ErrInvalidClient
+	login := dbTypes.OAuthLogin{
+		Client:   *client,
+		ClientID: client.ID,
+		Scope:    strings.Join(requested, " "),
 	}
 
-	user := dbTypes.User{}
-	if err := models.DB.Preload(clause.Associations).Where(dbTypes.User{CID: login.CID}).First(&user).Error; err != nil {
-		return nil, nil, ErrInvalidRequest
+	return &login, nil, nil
+}
+
+// ValidateScopes checks every requested scope is registered and allowed for
+// the client.
+func ValidateScopes(client *dbTypes.OAuthClient, requested []string) error {
+	settings, err := models.GetClientSettings(client.ID)
+	if err != nil {
+		return err
 	}
 
-	req.Scope = strings.Split(login.Scope, " ")
+	for _, name := range requested {
+		if _, err := scopes.Get(name); err != nil {
+			return ErrInvalidScope
+		}
+		if !settings.AllowsScope(name) {
+			return ErrInvalidScope
+		}
+	}
 
-	return &login, &user, nil
+	return nil
 }
 
-func CreateRefreshToken(login *dbTypes.OAuthLogin, user *dbTypes.User) (string, error) {
-	code, err := gonanoid.New(48)
-	if err != nil {
-		return "", err
-	}
-	token := dbTypes.OAuthLogin{
-		ClientID:  login.ClientID,
-		CID:       user.CID,
-		Token:     code,
-		Scope:     login.Scope,
-		UserAgent: login.UserAgent,
-		IP:        login.IP,
-		ExpiresAt: time.Now().Add(time.Second * 30 * 24 * 60 * 60),
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
-	if err := models.DB.Create(&token).Error; err != nil {
-		return "", err
-	}
-	return code, nil
+// SplitScopes normalizes scopes received either as repeated parameters or as a
+// single space delimited string.
+func SplitScopes(scope []string) []string {
+	return strings.Fields(strings.Join(scope, " "))
 }
 
-func CleanupAuthorization(req TokenRequest) (bool, error) {
-	switch req.GrantType {
-	case "authorization_code":
-		if err := models.DB.Joins("Client").Where("code = ?", req.Code).Delete(&dbTypes.OAuthLogin{}).Error; err != nil {
-			return false, ErrInvalidRequest
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
 		}
-		return true, nil
-	case "refresh_token":
-		if err := models.DB.Joins("Client").Where(dbTypes.OAuthLogin{Token: req.RefreshToken}).Delete(&dbTypes.OAuthLogin{}).Error; err != nil {
-			return false, ErrInvalidRequest
-		}
-		return true, nil
-	default:
-		return false, ErrInvalidGrant
 	}
+	return false
 }
@@ -0,0 +1,41 @@
+package login
+
+import (
+	"errors"
+	"testing"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/datatypes"
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/database/models/modelstest"
+)
+
+func TestValidateScopes(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   []string
+		requested []string
+		wantErr   error
+	}{
+		{name: "allowed", allowed: []string{"openid", "email"}, requested: []string{"openid", "email"}},
+		{name: "nothing requested", allowed: []string{"openid"}},
+		{name: "not allowed", allowed: []string{"openid"}, requested: []string{"openid", "roles"}, wantErr: ErrInvalidScope},
+		{name: "every scope", allowed: []string{models.AllScopes}, requested: []string{"openid", "roles"}},
+		{name: "unknown scope", allowed: []string{models.AllScopes}, requested: []string{"admin"}, wantErr: ErrInvalidScope},
+		{name: "openid without allowed scopes", requested: []string{"openid"}},
+		{name: "anything else without allowed scopes", requested: []string{"openid", "roles"}, wantErr: ErrInvalidScope},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modelstest.Setup(t)
+			if err := models.DB.Create(&models.OAuthClientSettings{ClientID: 1, AllowedScopes: datatypes.JSONMap(tt.allowed)}).Error; err != nil {
+				t.Fatalf("creating settings: %s", err)
+			}
+
+			if err := ValidateScopes(&dbTypes.OAuthClient{ID: 1}, tt.requested); !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
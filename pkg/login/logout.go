@@ -0,0 +1,53 @@
+package login
+
+import (
+	"fmt"
+	"strings"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/pkg/tokens"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// ParseIDTokenHint verifies an id_token_hint was signed by us. The hint is
+// usually expired by the time the user logs out, so only the signature is
+// checked. Access tokens aren't ID tokens and are rejected.
+func ParseIDTokenHint(hint string) (jwt.Token, error) {
+	msg, err := jws.Parse([]byte(hint))
+	if err != nil || len(msg.Signatures()) != 1 {
+		return nil, ErrInvalidToken
+	}
+	typ := strings.TrimPrefix(strings.ToLower(msg.Signatures()[0].ProtectedHeaders().Type()), "application/")
+	if typ == tokens.AccessTokenType {
+		return nil, ErrInvalidToken
+	}
+
+	t, err := jwt.Parse([]byte(hint), jwt.WithKeySet(tokens.PublicKeys()), jwt.WithValidate(false))
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	return t, nil
+}
+
+// Logout ends every grant cid has with client. Refresh token families are
+// revoked, which deletes their reference access tokens, and reference access
+// tokens issued without a refresh token are deleted too. JWT access tokens
+// can't be recalled and run out on their own.
+func Logout(client *dbTypes.OAuthClient, cid uint) error {
+	var families []string
+	if err := models.DB.Model(&models.OAuthRefreshFamily{}).
+		Where(&models.OAuthRefreshFamily{ClientID: client.ID, CID: cid}).
+		Where("revoked_at IS NULL").
+		Pluck("family_id", &families).Error; err != nil {
+		return err
+	}
+	for _, family := range families {
+		if err := RevokeFamily(family); err != nil {
+			return err
+		}
+	}
+
+	return models.DB.Where("client_id = ? AND subject = ?", client.ClientID, fmt.Sprint(cid)).Delete(&models.OAuthAccessToken{}).Error
+}
@@ -0,0 +1,198 @@
+package login
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/models"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"hawton.dev/log4g"
+)
+
+// Defaults for clients that don't set their own refresh token lifetimes
+var (
+	// How long a single refresh token may sit unused
+	RefreshTokenLifetime = time.Hour * 24 * 30
+	// How long a family may be rotated before the user must log in again
+	RefreshFamilyLifetime = time.Hour * 24 * 90
+)
+
+var securityLog = log4g.Category("security")
+
+func RefreshToken(client *dbTypes.OAuthClient, req TokenRequest) (*dbTypes.OAuthLogin, *dbTypes.User, error) {
+	if req.RefreshToken == "" {
+		return nil, nil, ErrInvalidRequest
+	}
+
+	login, err := FindRefreshToken(req.RefreshToken)
+	if err != nil {
+		detectReuse(req.RefreshToken)
+		return nil, nil, ErrInvalidGrant
+	}
+
+	// RFC6749 6, the refresh token must have been issued to the client
+	if login.ClientID != client.ID {
+		return nil, nil, ErrInvalidGrant
+	}
+
+	history := models.OAuthRefreshToken{}
+	if err := models.DB.Where("token_hash = ?", hashToken(req.RefreshToken)).First(&history).Error; err == nil {
+		family := models.OAuthRefreshFamily{}
+		if err := models.DB.Where("family_id = ?", history.FamilyID).First(&family).Error; err != nil {
+			return nil, nil, ErrInvalidGrant
+		}
+		if family.RevokedAt != nil || time.Now().After(family.ExpiresAt) {
+			return nil, nil, ErrInvalidGrant
+		}
+
+		// Claim the token, if someone beat us to it the token was replayed
+		result := models.DB.Model(&history).Where("used_at IS NULL").Update("used_at", time.Now())
+		if result.Error != nil {
+			return nil, nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			detectReuse(req.RefreshToken)
+			return nil, nil, ErrInvalidGrant
+		}
+	}
+	models.DB.Delete(login)
+
+	user, err := findUser(login.CID)
+	if err != nil {
+		return nil, nil, ErrInvalidRequest
+	}
+
+	return login, user, nil
+}
+
+// CreateRefreshToken issues a refresh token for the login. When the login is
+// itself a refresh token the new token joins its family, otherwise a new
+// family is started.
+func CreateRefreshToken(login *dbTypes.OAuthLogin, user *dbTypes.User, lifetimes Lifetimes) (string, error) {
+	family, err := familyFor(login, user, lifetimes.RefreshAbsolute)
+	if err != nil {
+		return "", err
+	}
+
+	code, err := gonanoid.New(48)
+	if err != nil {
+		return "", err
+	}
+
+	expiresAt := time.Now().Add(lifetimes.RefreshIdle)
+	if family.ExpiresAt.Before(expiresAt) {
+		expiresAt = family.ExpiresAt
+	}
+
+	token := dbTypes.OAuthLogin{
+		ClientID:  login.ClientID,
+		CID:       user.CID,
+		Token:     code,
+		Scope:     login.Scope,
+		UserAgent: login.UserAgent,
+		IP:        login.IP,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := models.DB.Create(&token).Error; err != nil {
+		return "", err
+	}
+
+	if err := models.DB.Create(&models.OAuthRefreshToken{
+		TokenHash: hashToken(code),
+		FamilyID:  family.FamilyID,
+		LoginID:   token.ID,
+	}).Error; err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+func familyFor(login *dbTypes.OAuthLogin, user *dbTypes.User, lifetime time.Duration) (*models.OAuthRefreshFamily, error) {
+	family := models.OAuthRefreshFamily{}
+
+	history := models.OAuthRefreshToken{}
+	if login.Token != "" {
+		if err := models.DB.Where("token_hash = ?", hashToken(login.Token)).First(&history).Error; err == nil {
+			if err := models.DB.Where("family_id = ?", history.FamilyID).First(&family).Error; err != nil {
+				return nil, err
+			}
+			if family.RevokedAt != nil {
+				return nil, ErrInvalidGrant
+			}
+			return &family, nil
+		}
+	}
+
+	id, err := gonanoid.New(32)
+	if err != nil {
+		return nil, err
+	}
+	family = models.OAuthRefreshFamily{
+		FamilyID:  id,
+		ClientID:  login.ClientID,
+		CID:       user.CID,
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+	if err := models.DB.Create(&family).Error; err != nil {
+		return nil, err
+	}
+
+	return &family, nil
+}
+
+// detectReuse revokes the whole family when an already rotated refresh token
+// is presented again. Either the legitimate client or an attacker holds a
+// stolen token, and we can't tell which, so nobody gets to keep going.
+func detectReuse(token string) {
+	history := models.OAuthRefreshToken{}
+	if err := models.DB.Where("token_hash = ? AND used_at IS NOT NULL", hashToken(token)).First(&history).Error; err != nil {
+		return
+	}
+
+	family := models.OAuthRefreshFamily{}
+	if err := models.DB.Where("family_id = ?", history.FamilyID).First(&family).Error; err != nil {
+		return
+	}
+
+	securityLog.Warning("Refresh token reuse detected in family %s for client %d and cid %d, revoking family", family.FamilyID, family.ClientID, family.CID)
+	if err := RevokeFamily(family.FamilyID); err != nil {
+		securityLog.Error("Failed to revoke refresh token family %s: %s", family.FamilyID, err.Error())
+	}
+}
+
+// RevokeFamily marks the family revoked and deletes every token of it that
+// is still usable, reference access tokens issued with it included.
+func RevokeFamily(familyID string) error {
+	now := time.Now()
+	if err := models.DB.Model(&models.OAuthRefreshFamily{}).Where("family_id = ?", familyID).Update("revoked_at", &now).Error; err != nil {
+		return err
+	}
+
+	if err := models.DB.Where("family_id = ?", familyID).Delete(&models.OAuthAccessToken{}).Error; err != nil {
+		return err
+	}
+
+	return models.DB.Where("id IN (?)",
+		models.DB.Model(&models.OAuthRefreshToken{}).Select("login_id").Where("family_id = ?", familyID),
+	).Delete(&dbTypes.OAuthLogin{}).Error
+}
+
+// FamilyOf returns the family a refresh token belongs to, or "" when it
+// belongs to none.
+func FamilyOf(refreshToken string) string {
+	history := models.OAuthRefreshToken{}
+	if err := models.DB.Where("token_hash = ?", hashToken(refreshToken)).First(&history).Error; err != nil {
+		return ""
+	}
+	return history.FamilyID
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
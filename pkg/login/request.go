@@ -0,0 +1,174 @@
+package login
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+var (
+	ErrInvalidRequestObject = errors.New("invalid_request_object")
+	ErrInvalidRequestURI    = errors.New("invalid_request_uri")
+)
+
+// Request objects are small, anything bigger than this is not one
+const maxRequestObjectSize = 64 * 1024
+
+// MaxRequestObjectLifetime is how far ahead a request object may expire. Per
+// RFC9101 10.8 they should be short lived, a captured one can be replayed
+// until it does.
+var MaxRequestObjectLifetime = 10 * time.Minute
+
+// RequestURIClient fetches request objects from request_uri. Redirects aren't
+// followed, they could lead anywhere, and internal addresses aren't dialed.
+var RequestURIClient = &http.Client{
+	Timeout:   5 * time.Second,
+	Transport: externalTransport(),
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// RequestObject returns the verified claims of a RFC9101 request object,
+// passed by value or fetched from requestURI. The object must be signed by
+// one of the client's registered keys, be meant for the client, be addressed
+// to one of audiences and expire within MaxRequestObjectLifetime.
+func RequestObject(ctx context.Context, client *dbTypes.OAuthClient, request, requestURI string, audiences []string) (jwt.Token, error) {
+	if request != "" && requestURI != "" {
+		return nil, ErrInvalidRequest
+	}
+
+	settings, err := models.GetClientSettings(client.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if requestURI != "" {
+		request, err = fetchRequestObject(ctx, settings, requestURI)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keys, err := ClientKeys(ctx, settings)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRequestObject, err.Error())
+	}
+
+	token, err := jwt.Parse([]byte(request),
+		jwt.WithKeySet(keys, jws.WithRequireKid(false), jws.WithInferAlgorithmFromKey(true)),
+		jwt.WithValidate(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRequestObject, err.Error())
+	}
+
+	if v, ok := token.Get("client_id"); !ok || fmt.Sprint(v) != client.ClientID {
+		return nil, fmt.Errorf("%w: client_id does not match", ErrInvalidRequestObject)
+	}
+	if token.Issuer() != "" && token.Issuer() != client.ClientID {
+		return nil, fmt.Errorf("%w: iss does not match", ErrInvalidRequestObject)
+	}
+	if !containsAny(token.Audience(), audiences) {
+		return nil, fmt.Errorf("%w: aud does not match", ErrInvalidRequestObject)
+	}
+	if token.Expiration().IsZero() {
+		return nil, fmt.Errorf("%w: exp is required", ErrInvalidRequestObject)
+	}
+	if time.Until(token.Expiration()) > MaxRequestObjectLifetime {
+		return nil, fmt.Errorf("%w: exp is more than %s away", ErrInvalidRequestObject, MaxRequestObjectLifetime)
+	}
+
+	return token, nil
+}
+
+// fetchRequestObject fetches a request object from one of the request uris
+// the client registered, anything else would let clients make us fetch
+// arbitrary URLs.
+func fetchRequestObject(ctx context.Context, settings *models.OAuthClientSettings, requestURI string) (string, error) {
+	allowed := false
+	for _, registered := range settings.RequestURIs {
+		if requestURIMatches(registered, requestURI) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", fmt.Errorf("%w: not registered", ErrInvalidRequestURI)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURI, nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidRequestURI, err.Error())
+	}
+	req.Header.Set("Accept", "application/oauth-authz-req+jwt")
+
+	resp, err := RequestURIClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidRequestURI, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: status %d", ErrInvalidRequestURI, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRequestObjectSize))
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidRequestURI, err.Error())
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+// requestURIMatches reports whether uri is covered by a registered request
+// uri. Scheme and host must be the same, and a registered path ending in /
+// covers everything below it. Otherwise the whole URL must match.
+func requestURIMatches(registered, uri string) bool {
+	r, err := url.Parse(registered)
+	if err != nil || r.Scheme != "https" || r.Host == "" || r.User != nil {
+		return false
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "https" || u.User != nil || u.Fragment != "" {
+		return false
+	}
+	if !strings.EqualFold(r.Host, u.Host) {
+		return false
+	}
+
+	if r.RawQuery == "" && strings.HasSuffix(r.Path, "/") {
+		return strings.HasPrefix(u.Path, r.Path) && isCleanPath(u.Path)
+	}
+	return r.Path == u.Path && r.RawQuery == u.RawQuery
+}
+
+// isCleanPath reports whether p has no . or .. segments that could step out
+// of a registered path.
+func isCleanPath(p string) bool {
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean == p
+}
+
+func containsAny(s []string, e []string) bool {
+	for _, a := range e {
+		if contains(s, a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package login
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adh-partnership/sso/database/models"
+)
+
+func TestRequestURIMatches(t *testing.T) {
+	tests := []struct {
+		registered string
+		uri        string
+		want       bool
+	}{
+		{registered: "https://app.example.com/requests/", uri: "https://app.example.com/requests/1", want: true},
+		{registered: "https://app.example.com/requests/", uri: "https://APP.example.com/requests/1", want: true},
+		{registered: "https://app.example.com/requests/1", uri: "https://app.example.com/requests/1", want: true},
+		{registered: "https://app.example.com/requests/1?v=1", uri: "https://app.example.com/requests/1?v=1", want: true},
+		{registered: "https://app.example.com/requests/1", uri: "https://app.example.com/requests/12"},
+		{registered: "https://app.example.com/requests/1?v=1", uri: "https://app.example.com/requests/1?v=2"},
+		{registered: "https://app.example.com", uri: "https://app.example.com.evil.net/requests/1"},
+		{registered: "https://app.example.com/", uri: "https://app.example.com.evil.net/requests/1"},
+		{registered: "https://app.example.com/", uri: "https://app.example.com:8443/requests/1"},
+		{registered: "https://app.example.com/requests/", uri: "https://app.example.com/requests/../admin"},
+		{registered: "https://app.example.com/requests/", uri: "https://app.example.com/requests/%2e%2e/admin"},
+		{registered: "https://app.example.com/requests/", uri: "https://user@app.example.com/requests/1"},
+		{registered: "https://app.example.com/requests/", uri: "http://app.example.com/requests/1"},
+		{registered: "https://", uri: "https://internal.example.com/"},
+		{registered: "http://app.example.com/", uri: "http://app.example.com/requests/1"},
+	}
+
+	for _, tt := range tests {
+		if got := requestURIMatches(tt.registered, tt.uri); got != tt.want {
+			t.Errorf("requestURIMatches(%q, %q): expected %v, got %v", tt.registered, tt.uri, tt.want, got)
+		}
+	}
+}
+
+func TestFetchRequestObject(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/requests/object":
+			w.Write([]byte("  the.request.object\n"))
+		case "/requests/redirect":
+			http.Redirect(w, r, "/internal", http.StatusFound)
+		case "/internal":
+			w.Write([]byte("internal"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	transport := RequestURIClient.Transport
+	RequestURIClient.Transport = server.Client().Transport
+	defer func() { RequestURIClient.Transport = transport }()
+
+	settings := &models.OAuthClientSettings{RequestURIs: []string{server.URL + "/requests/"}}
+
+	tests := []struct {
+		name    string
+		uri     string
+		want    string
+		wantErr error
+	}{
+		{name: "registered", uri: server.URL + "/requests/object", want: "the.request.object"},
+		{name: "not registered", uri: server.URL + "/internal", wantErr: ErrInvalidRequestURI},
+		{name: "redirects are not followed", uri: server.URL + "/requests/redirect", wantErr: ErrInvalidRequestURI},
+		{name: "not found", uri: server.URL + "/requests/missing", wantErr: ErrInvalidRequestURI},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fetchRequestObject(context.Background(), settings, tt.uri)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("expected %q, %v, got %q, %v", tt.want, tt.wantErr, got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package login
+
+import (
+	"errors"
+	"fmt"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/pkg/tokens"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+var ErrUnauthorizedClient error = errors.New("unauthorized_client")
+
+// Revoke invalidates a refresh token or an access token issued to client.
+// Per RFC7009 2.2 unknown or already invalid tokens are not an error.
+func Revoke(client *dbTypes.OAuthClient, token, hint string) error {
+	if hint == "access_token" {
+		if ok, err := revokeAccessToken(client, token); ok || err != nil {
+			return err
+		}
+		_, err := revokeRefreshToken(client, token)
+		return err
+	}
+
+	if ok, err := revokeRefreshToken(client, token); ok || err != nil {
+		return err
+	}
+	_, err := revokeAccessToken(client, token)
+	return err
+}
+
+func revokeRefreshToken(client *dbTypes.OAuthClient, token string) (bool, error) {
+	login, err := FindRefreshToken(token)
+	if err != nil {
+		return false, nil
+	}
+
+	if login.ClientID != client.ID {
+		return true, ErrUnauthorizedClient
+	}
+
+	// Revoking a refresh token ends the whole grant, not just this rotation
+	history := models.OAuthRefreshToken{}
+	if err := models.DB.Where("token_hash = ?", hashToken(token)).First(&history).Error; err == nil {
+		return true, RevokeFamily(history.FamilyID)
+	}
+
+	return true, models.DB.Delete(login).Error
+}
+
+func revokeAccessToken(client *dbTypes.OAuthClient, token string) (bool, error) {
+	if ref, err := FindReferenceToken(token); err == nil {
+		if ref.ClientID != client.ClientID {
+			return true, ErrUnauthorizedClient
+		}
+		return true, models.DB.Delete(ref).Error
+	}
+
+	t, err := tokens.ParseAccessToken([]byte(token))
+	if err != nil || t.JwtID() == "" {
+		return false, nil
+	}
+
+	if v, _ := t.Get("client_id"); fmt.Sprint(v) != client.ClientID {
+		return true, ErrUnauthorizedClient
+	}
+
+	if revoked, err := IsRevoked(t); revoked || err != nil {
+		return true, err
+	}
+
+	return true, models.DB.Create(&models.OAuthRevokedToken{
+		JTI:       t.JwtID(),
+		ExpiresAt: t.Expiration(),
+	}).Error
+}
+
+// IsRevoked reports whether the token was revoked. When that can't be looked
+// up the error is returned and the token must be treated as invalid.
+func IsRevoked(t jwt.Token) (bool, error) {
+	if t.JwtID() == "" {
+		return false, nil
+	}
+
+	var count int64
+	if err := models.DB.Model(&models.OAuthRevokedToken{}).Where("jti = ?", t.JwtID()).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,50 @@
+package login
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adh-partnership/sso/database/models"
+	"github.com/adh-partnership/sso/database/models/modelstest"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+func TestIsRevoked(t *testing.T) {
+	tokenWithID := func(jti string) jwt.Token {
+		token := jwt.New()
+		if jti != "" {
+			token.Set(jwt.JwtIDKey, jti)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name    string
+		token   jwt.Token
+		broken  bool // The lookup fails
+		want    bool
+		wantErr bool
+	}{
+		{name: "revoked", token: tokenWithID("revoked"), want: true},
+		{name: "not revoked", token: tokenWithID("other")},
+		{name: "without a jti", token: tokenWithID("")},
+		{name: "failing lookup", token: tokenWithID("other"), broken: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modelstest.Setup(t)
+			if err := models.DB.Create(&models.OAuthRevokedToken{JTI: "revoked", ExpiresAt: time.Now().Add(time.Hour)}).Error; err != nil {
+				t.Fatalf("revoking token: %s", err)
+			}
+			if tt.broken {
+				models.DB.Migrator().DropTable(&models.OAuthRevokedToken{})
+			}
+
+			got, err := IsRevoked(tt.token)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("expected %v and an error %v, got %v: %v", tt.want, tt.wantErr, got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package scopes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+type Scope struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Claims unlocked in the id token and userinfo response by this scope
+	Claims []string `json:"claims"`
+	// Scopes describing a user can't be granted to a client acting as itself
+	RequiresUser bool `json:"requires_user"`
+}
+
+var (
+	ErrUnknownScope     = errors.New("unknown scope")
+	ErrInvalidScopeName = errors.New("scope must have a name")
+)
+
+// Registry is every scope a client may request, in the order they are
+// advertised in discovery.
+var Registry = []Scope{
+	{
+		Name:         "openid",
+		Description:  "Sign you in and identify you by your CID",
+		Claims:       []string{"sub"},
+		RequiresUser: true,
+	},
+	{
+		Name:         "profile",
+		Description:  "Read your name",
+		Claims:       []string{"name", "given_name", "family_name"},
+		RequiresUser: true,
+	},
+	{
+		Name:         "email",
+		Description:  "Read your email address",
+		Claims:       []string{"email"},
+		RequiresUser: true,
+	},
+	{
+		Name:         "rating",
+		Description:  "Read your controller rating",
+		Claims:       []string{"rating"},
+		RequiresUser: true,
+	},
+	{
+		Name:         "roles",
+		Description:  "Read your facility roles",
+		Claims:       []string{"roles"},
+		RequiresUser: true,
+	},
+}
+
+func Get(name string) (Scope, error) {
+	for _, scope := range Registry {
+		if scope.Name == name {
+			return scope, nil
+		}
+	}
+	return Scope{}, ErrUnknownScope
+}
+
+func Names() []string {
+	names := []string{}
+	for _, scope := range Registry {
+		names = append(names, scope.Name)
+	}
+	return names
+}
+
+// Claims returns the claims unlocked by the given scopes, unknown scopes
+// unlock nothing.
+func Claims(names []string) []string {
+	claims := []string{}
+	for _, name := range names {
+		scope, err := Get(name)
+		if err != nil {
+			continue
+		}
+		claims = append(claims, scope.Claims...)
+	}
+	return claims
+}
+
+// ClaimNames returns every claim any registered scope can unlock.
+func ClaimNames() []string {
+	return Claims(Names())
+}
+
+// LoadFile registers the additional scopes defined in a JSON file, mostly
+// for APIs that client_credentials clients are granted access to.
+func LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	extra := []Scope{}
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return err
+	}
+
+	for _, scope := range extra {
+		if scope.Name == "" {
+			return ErrInvalidScopeName
+		}
+		if _, err := Get(scope.Name); err == nil {
+			return fmt.Errorf("scope %s is already registered", scope.Name)
+		}
+		Registry = append(Registry, scope)
+	}
+
+	return nil
+}
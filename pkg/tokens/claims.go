@@ -0,0 +1,115 @@
+package tokens
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	dbTypes "github.com/adh-partnership/api/pkg/database/models"
+	"github.com/adh-partnership/sso/pkg/claims"
+	"github.com/adh-partnership/sso/pkg/scopes"
+)
+
+// UserClaims returns the claims about user that the granted scopes unlock in
+// the scope registry. sub is always included.
+func UserClaims(user *dbTypes.User, granted []string) map[string]interface{} {
+	roles := []string{}
+	for _, role := range user.Roles {
+		roles = append(roles, role.Name)
+	}
+
+	all := map[string]interface{}{
+		"sub":         fmt.Sprint(user.CID),
+		"name":        fmt.Sprintf("%s %s", user.FirstName, user.LastName),
+		"given_name":  user.FirstName,
+		"family_name": user.LastName,
+		"email":       user.Email,
+		"rating": map[string]interface{}{
+			"id":    user.Rating.ID,
+			"short": user.Rating.Short,
+			"long":  user.Rating.Long,
+		},
+		"roles": roles,
+	}
+
+	claims := map[string]interface{}{
+		"sub": all["sub"],
+	}
+	for _, name := range scopes.Claims(granted) {
+		if v, ok := all[name]; ok {
+			claims[name] = v
+		}
+	}
+
+	return claims
+}
+
+// Claims returns the claims about user for target, the defaults for target
+// with the client's mappings applied on top.
+func Claims(target string, user *dbTypes.User, granted []string, mappings claims.Mappings) map[string]interface{} {
+	var out map[string]interface{}
+	switch target {
+	case claims.TargetAccessToken:
+		out = map[string]interface{}{
+			"roles": claims.Sources["roles"](user),
+		}
+	case claims.TargetIDToken:
+		out = map[string]interface{}{
+			"name":        claims.Sources["name"](user),
+			"given_name":  user.FirstName,
+			"family_name": user.LastName,
+			"email":       user.Email,
+			"roles":       claims.Sources["roles"](user),
+		}
+	default:
+		out = UserClaims(user, granted)
+	}
+
+	for _, mapping := range mappings {
+		if !mapping.AppliesTo(target, granted) {
+			continue
+		}
+		source, ok := claims.Sources[mapping.Source]
+		if !ok {
+			continue
+		}
+		if !claims.Convertible(mapping.Source, mapping.Type) {
+			continue
+		}
+		if v, ok := convertClaim(source(user), mapping.Type); ok {
+			out[mapping.Claim] = v
+		}
+	}
+
+	return out
+}
+
+// convertClaim converts a source value to the type a mapping asked for, ok is
+// false when it can't be, in which case the claim is left out.
+func convertClaim(v interface{}, typ string) (interface{}, bool) {
+	switch typ {
+	case claims.TypeString:
+		if list, ok := v.([]string); ok {
+			return strings.Join(list, ","), true
+		}
+		return fmt.Sprint(v), true
+	case claims.TypeNumber:
+		n, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+		return n, err == nil
+	case claims.TypeBoolean:
+		switch value := v.(type) {
+		case []string:
+			return len(value) > 0, true
+		case string:
+			return value != "" && value != "none" && value != "false" && value != "0", true
+		default:
+			return fmt.Sprint(v) != "0", true
+		}
+	case claims.TypeArray:
+		if list, ok := v.([]string); ok {
+			return list, true
+		}
+		return []string{fmt.Sprint(v)}, true
+	}
+	return v, true
+}
@@ -0,0 +1,119 @@
+package tokens
+
+import (
+	"fmt"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwe"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// DefaultEncryption is the content encryption used when a client asks for a
+// key encryption algorithm without an enc, OpenID Connect Registration 2.
+const DefaultEncryption = jwa.A128CBC_HS256
+
+// Key encryption algorithms clients may ask for. RSA1_5 is left out on
+// purpose, as are the symmetric ones as we only know public keys.
+var EncryptionAlgorithms = []jwa.KeyEncryptionAlgorithm{
+	jwa.RSA_OAEP,
+	jwa.RSA_OAEP_256,
+	jwa.ECDH_ES,
+	jwa.ECDH_ES_A128KW,
+	jwa.ECDH_ES_A192KW,
+	jwa.ECDH_ES_A256KW,
+}
+
+var EncryptionEncodings = []jwa.ContentEncryptionAlgorithm{
+	jwa.A128CBC_HS256,
+	jwa.A192CBC_HS384,
+	jwa.A256CBC_HS512,
+	jwa.A128GCM,
+	jwa.A192GCM,
+	jwa.A256GCM,
+}
+
+var (
+	ErrUnsupportedEncryption = fmt.Errorf("unsupported encryption algorithm")
+	ErrNoEncryptionKey       = fmt.Errorf("no key to encrypt to")
+)
+
+// Encrypt wraps payload in a compact JWE to one of the client's keys. When
+// payload is a signed token, cty is "JWT" so the client knows it is nested.
+func Encrypt(payload []byte, keys jwk.Set, alg, enc string, nested bool) ([]byte, error) {
+	keyAlg, ok := encryptionAlgorithm(alg)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncryption, alg)
+	}
+	if enc == "" {
+		enc = DefaultEncryption.String()
+	}
+	contentAlg, ok := encryptionEncoding(enc)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncryption, enc)
+	}
+
+	key, err := encryptionKey(keys, keyAlg)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := jwe.NewHeaders()
+	if key.KeyID() != "" {
+		headers.Set(jwe.KeyIDKey, key.KeyID())
+	}
+	if nested {
+		headers.Set(jwe.ContentTypeKey, "JWT")
+	}
+
+	return jwe.Encrypt(payload,
+		jwe.WithKey(keyAlg, key),
+		jwe.WithContentEncryption(contentAlg),
+		jwe.WithProtectedHeaders(headers),
+		jwe.WithCompact(),
+	)
+}
+
+// encryptionKey picks the first key meant for encryption that works with alg.
+// Keys that say which alg they are for must say this one.
+func encryptionKey(keys jwk.Set, alg jwa.KeyEncryptionAlgorithm) (jwk.Key, error) {
+	want := jwa.RSA
+	if alg != jwa.RSA_OAEP && alg != jwa.RSA_OAEP_256 {
+		want = jwa.EC
+	}
+
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Key(i)
+		if key.KeyUsage() != "" && key.KeyUsage() != string(jwk.ForEncryption) {
+			continue
+		}
+		if key.Algorithm().String() != "" && key.Algorithm().String() != alg.String() {
+			continue
+		}
+		if key.KeyType() == want {
+			return key, nil
+		}
+		if okp, ok := key.(jwk.OKPPublicKey); ok && want == jwa.EC && okp.Crv() == jwa.X25519 {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrNoEncryptionKey, alg)
+}
+
+func encryptionAlgorithm(alg string) (jwa.KeyEncryptionAlgorithm, bool) {
+	for _, a := range EncryptionAlgorithms {
+		if a.String() == alg {
+			return a, true
+		}
+	}
+	return "", false
+}
+
+func encryptionEncoding(enc string) (jwa.ContentEncryptionAlgorithm, bool) {
+	for _, e := range EncryptionEncodings {
+		if e.String() == enc {
+			return e, true
+		}
+	}
+	return "", false
+}
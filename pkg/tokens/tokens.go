@@ -1,76 +1,243 @@
 package tokens
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"math/rand"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/lestrrat-go/jwx/v2/jwt"
+	gonanoid "github.com/matoous/go-nanoid/v2"
 )
 
-var JWKS string
-var KeySet jwk.Set
+var (
+	mu sync.RWMutex
+	// Private keys new tokens are signed with
+	signingSet jwk.Set = jwk.NewSet()
+	// Public keys tokens are verified against and that /oauth/certs publishes,
+	// this includes keys that don't sign (yet or anymore)
+	publicSet jwk.Set = jwk.NewSet()
+	// publicSet encoded once per key change, and its ETag
+	publicJWKS []byte = []byte(`{"keys":[]}`)
+	publicETag string = etag(publicJWKS)
+)
 
 var (
-	ErrNoKeys = fmt.Errorf("no keys available")
+	ErrNoKeys      = fmt.Errorf("no keys available")
+	ErrNoKeyForAlg = fmt.Errorf("no active key for algorithm")
 )
 
+// DefaultAlgorithm signs tokens for clients that didn't ask for anything else
+const DefaultAlgorithm = jwa.RS256
+
+// AccessTokenType is the typ header of JWT access tokens, RFC9068 2.1. It is
+// what keeps an ID token, or anything else we sign, from passing as one.
+const AccessTokenType = "at+jwt"
+
+var ErrNotAccessToken = fmt.Errorf("not an access token")
+
+// BuildKeyset signs and verifies with every key of a private JWKS.
 func BuildKeyset(jwks string) error {
-	var err error
-	JWKS = jwks
-	KeySet, err = jwk.Parse([]byte(JWKS))
+	keyset, err := jwk.Parse([]byte(jwks))
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return SetKeys(keyset, keyset)
 }
 
-func GetRandomKey() (jwk.Key, bool) {
-	return KeySet.Key(rand.Intn(KeySet.Len()))
+// SetKeys swaps the keys in use. signing must hold private keys, verifying
+// may hold either and is reduced to the public keys. Keys signed with are
+// given their thumbprint as kid if they have none, so every token has a kid
+// header relying parties can pick the key by.
+func SetKeys(signing, verifying jwk.Set) error {
+	for i := 0; i < signing.Len(); i++ {
+		key, _ := signing.Key(i)
+		if key.KeyID() == "" {
+			if err := jwk.AssignKeyID(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	pub, err := publicSetOf(verifying)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(pub)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	signingSet = signing
+	publicSet = pub
+	publicJWKS = data
+	publicETag = etag(data)
+
+	return nil
 }
 
-// Kubernetes' OIDC client only supports RS256 signed keys
-// so make sure we only get those
-func GetRandomKubernetesKey() (jwk.Key, bool) {
-	var key jwk.Key
-	var b bool
-	for key.Algorithm() != jwa.RS256 {
-		key, b = GetRandomKey()
+// publicSetOf is jwk.PublicSetOf without symmetric keys, the "public" key of
+// an oct key is the secret itself.
+func publicSetOf(set jwk.Set) (jwk.Set, error) {
+	pub := jwk.NewSet()
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Key(i)
+		if key.KeyType() == jwa.OctetSeq {
+			continue
+		}
+		pk, err := key.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		pub.AddKey(pk)
 	}
+	return pub, nil
+}
 
-	return key, b
+func etag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
 }
 
-func CreateTokenKubernetes(issuer, audience, subject string, ttl int, claims map[string]interface{}) ([]byte, error) {
-	key, ok := GetRandomKubernetesKey()
-	if !ok {
+// Keys returns the private keys new tokens are signed with.
+func Keys() jwk.Set {
+	mu.RLock()
+	defer mu.RUnlock()
+	return signingSet
+}
+
+// PublicKeys returns every public key tokens may be verified with.
+func PublicKeys() jwk.Set {
+	mu.RLock()
+	defer mu.RUnlock()
+	return publicSet
+}
+
+// PublicJWKS returns PublicKeys encoded as a JWK Set and a strong ETag for it.
+func PublicJWKS() ([]byte, string) {
+	mu.RLock()
+	defer mu.RUnlock()
+	return publicJWKS, publicETag
+}
+
+// SigningKey returns the active key new tokens signed with alg use. When
+// several keys are active for alg the most recently activated one wins.
+func SigningKey(alg jwa.SignatureAlgorithm) (jwk.Key, error) {
+	keys := Keys()
+	if keys.Len() == 0 {
 		return nil, ErrNoKeys
 	}
 
-	return createTokenFromKey(key, issuer, audience, subject, ttl, claims)
+	var found jwk.Key
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Key(i)
+		if key.Algorithm() == alg {
+			found = key
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoKeyForAlg, alg)
+	}
+
+	return found, nil
+}
+
+// Algorithms returns the algorithms there is an active key for.
+func Algorithms() []string {
+	keys := Keys()
+	var algs []string
+	seen := map[string]bool{}
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Key(i)
+		alg := key.Algorithm().String()
+		if !seen[alg] {
+			seen[alg] = true
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+func CreateToken(alg jwa.SignatureAlgorithm, issuer, audience, subject string, ttl int, claims map[string]interface{}) ([]byte, error) {
+	key, err := SigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	return createTokenFromKey(key, "", issuer, audience, subject, ttl, claims)
+}
+
+// CreateAccessToken is CreateToken for JWT access tokens, they are typed as
+// such.
+func CreateAccessToken(alg jwa.SignatureAlgorithm, issuer, audience, subject string, ttl int, claims map[string]interface{}) ([]byte, error) {
+	key, err := SigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	return createTokenFromKey(key, AccessTokenType, issuer, audience, subject, ttl, claims)
 }
 
-func CreateToken(issuer, audience, subject string, ttl int, claims map[string]interface{}) ([]byte, error) {
-	key, ok := GetRandomKey()
-	if !ok {
+// ParseToken verifies a token was signed by one of our keys and that its
+// registered claims (exp, nbf, iat) are valid.
+func ParseToken(token []byte) (jwt.Token, error) {
+	pub := PublicKeys()
+	if pub.Len() == 0 {
 		return nil, ErrNoKeys
 	}
 
-	return createTokenFromKey(key, issuer, audience, subject, ttl, claims)
+	return jwt.Parse(token, jwt.WithKeySet(pub), jwt.WithValidate(true))
 }
 
-func createTokenFromKey(key jwk.Key, issuer, audience, subject string, ttl int, claims map[string]interface{}) ([]byte, error) {
+// ParseAccessToken is ParseToken for access tokens, tokens without the
+// access token typ are rejected.
+func ParseAccessToken(token []byte) (jwt.Token, error) {
+	msg, err := jws.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Signatures()) != 1 {
+		return nil, ErrNotAccessToken
+	}
+	// RFC9068 4, the application/ prefix may be left out
+	typ := strings.TrimPrefix(strings.ToLower(msg.Signatures()[0].ProtectedHeaders().Type()), "application/")
+	if typ != AccessTokenType {
+		return nil, ErrNotAccessToken
+	}
+
+	return ParseToken(token)
+}
+
+func createTokenFromKey(key jwk.Key, typ, issuer, audience, subject string, ttl int, claims map[string]interface{}) ([]byte, error) {
+	jti, err := gonanoid.New(32)
+	if err != nil {
+		return nil, err
+	}
+
 	token := jwt.New()
 	token.Set(jwt.IssuerKey, issuer)
 	token.Set(jwt.AudienceKey, audience)
 	token.Set(jwt.SubjectKey, subject)
 	token.Set(jwt.IssuedAtKey, time.Now())
+	token.Set(jwt.JwtIDKey, jti)
 	token.Set(jwt.ExpirationKey, time.Now().Add(time.Duration(ttl)*time.Second).Unix())
 	for k, v := range claims {
 		token.Set(k, v)
 	}
 
-	return jwt.Sign(token, jwt.WithKey(key.Algorithm(), key))
+	// Without a typ jwx sets JWT
+	headers := jws.NewHeaders()
+	if typ != "" {
+		headers.Set(jws.TypeKey, typ)
+	}
+	return jwt.Sign(token, jwt.WithKey(key.Algorithm(), key, jws.WithProtectedHeaders(headers)))
 }
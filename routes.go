@@ -20,9 +20,11 @@ package main
 
 import (
 	"net/http"
+	"strings"
 
 	v1 "github.com/adh-partnership/sso/controllers/v1"
 	jwtMiddleware "github.com/adh-partnership/sso/middleware/jwt"
+	"github.com/adh-partnership/sso/utils"
 	"github.com/gin-gonic/gin"
 )
 
@@ -40,11 +42,40 @@ func SetupRoutes(engine *gin.Engine) {
 		OAuthRouter.GET("/callback", v1.GetCallback)
 		OAuthRouter.GET("/certs", v1.GetCerts)
 		OAuthRouter.POST("/token", v1.PostToken)
+		OAuthRouter.POST("/introspect", v1.PostIntrospect)
+		OAuthRouter.POST("/revoke", v1.PostRevoke)
+		OAuthRouter.GET("/logout", v1.GetLogout)
+		OAuthRouter.POST("/logout", v1.GetLogout)
+		OAuthRouter.GET("/userinfo", v1.GetUserInfo)
+		OAuthRouter.POST("/userinfo", v1.GetUserInfo)
+		OAuthRouter.POST("/device_authorization", v1.PostDeviceAuthorization)
+		OAuthRouter.GET("/device", v1.GetDevice)
+		OAuthRouter.POST("/device", v1.PostDevice)
+		OAuthRouter.POST("/register", v1.PostRegister)
+		OAuthRouter.GET("/register/:client_id", v1.GetRegistration)
+		OAuthRouter.PUT("/register/:client_id", v1.PutRegistration)
+		OAuthRouter.DELETE("/register/:client_id", v1.DeleteRegistration)
 	}
 
 	v1Router := engine.Group("/v1")
 	{
 		v1Router.GET("/info", jwtMiddleware.Auth, v1.GetInfo)
+
+		adminRoles := strings.Split(utils.Getenv("SSO_ADMIN_ROLES", "wm"), ",")
+		// Only the admin UI's tokens, not those of every client an admin logs in to
+		adminClients := strings.Split(utils.Getenv("SSO_ADMIN_CLIENT_IDS", ""), ",")
+		adminRouter := v1Router.Group("/admin", jwtMiddleware.Auth, jwtMiddleware.RequireClient(adminClients...), jwtMiddleware.RequireRole(adminRoles...))
+		{
+			adminRouter.GET("/clients", v1.GetAdminClients)
+			adminRouter.POST("/clients", v1.PostAdminClient)
+			adminRouter.GET("/clients/:id", v1.GetAdminClient)
+			adminRouter.PUT("/clients/:id", v1.PutAdminClient)
+			adminRouter.DELETE("/clients/:id", v1.DeleteAdminClient)
+			adminRouter.POST("/clients/:id/secret", v1.PostAdminClientSecret)
+			adminRouter.GET("/initial_access_tokens", v1.GetAdminInitialAccessTokens)
+			adminRouter.POST("/initial_access_tokens", v1.PostAdminInitialAccessToken)
+			adminRouter.DELETE("/initial_access_tokens/:id", v1.DeleteAdminInitialAccessToken)
+		}
 	}
 
 	engine.GET("/.well-known/openid-configuration", v1.GetOIDCConfig)